@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/auth"
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// maximum accepted size of an uploaded backup archive
+const maxRestoreSize int64 = 256 << 20
+
+// checks the ApiKey Authorization header against ADMIN_KEY,
+// responding with an error if it does not match
+func (a *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "could not find api key")
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(a.adminKey)) != 1 {
+		utils.RespondWithError(w, http.StatusUnauthorized, "api key is invalid")
+		return false
+	}
+	return true
+}
+
+// handler to be used with serveMux.HandleFunc()
+// this handler streams a compressed snapshot of the database
+func (a *apiConfig) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeAdmin(w, r) {
+		return
+	}
+
+	filename := fmt.Sprintf("chirpy-%s.json.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	err := a.DB.Backup(w)
+	if err != nil {
+		// headers are likely sent already, so all we can do is log
+		log.Printf("could not write backup: %s", err)
+	}
+}
+
+// handler to be used with serveMux.HandleFunc()
+// this handler replaces all data with the uploaded backup archive
+func (a *apiConfig) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeAdmin(w, r) {
+		return
+	}
+
+	err := a.DB.Restore(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	if err != nil {
+		if errors.Is(err, database.ErrArchiveTooLarge) || errors.As(err, new(*http.MaxBytesError)) {
+			utils.RespondWithError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrInvalidBackup) || errors.Is(err, database.ErrSchemaTooNew) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not restore backup")
+		return
+	}
+
+	// a restore bypasses the change feed, so the search index and trends start over
+	a.searchIndex.Resync()
+	a.trends.Resync()
+	// the restored database may hold other scheduled chirps
+	a.wakeScheduler()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,23 +2,105 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/Katalcha/go-chirpy/internal/auth"
+	"github.com/Katalcha/go-chirpy/internal/database"
 	"github.com/Katalcha/go-chirpy/internal/utils"
 )
 
+// LikedByMe and RechirpedByMe are only set for requests with a valid jwt
 type Chirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+	ID            int               `json:"id"`
+	AuthorID      int               `json:"author_id"`
+	Body          string            `json:"body"`
+	InReplyTo     int               `json:"in_reply_to,omitempty"`
+	RootID        int               `json:"root_id,omitempty"`
+	Entities      []database.Entity `json:"entities"`
+	Media         []Media           `json:"media"`
+	ReplyCount    int               `json:"reply_count"`
+	Likes         int               `json:"likes"`
+	Rechirps      int               `json:"rechirps"`
+	LikedByMe     *bool             `json:"liked_by_me,omitempty"`
+	RechirpedByMe *bool             `json:"rechirped_by_me,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+	Edited        bool              `json:"edited"`
+	EditedAt      *time.Time        `json:"edited_at,omitempty"`
+	DeletedAt     *time.Time        `json:"deleted_at,omitempty"`
+}
+
+// maps a database.Chirp to its JSON response,
+// the counts are filled in by setCounts
+func chirpFromDB(dbChirp database.Chirp) Chirp {
+	if dbChirp.Entities == nil {
+		dbChirp.Entities = []database.Entity{}
+	}
+	media := make([]Media, len(dbChirp.Media))
+	for i, dbMedia := range dbChirp.Media {
+		media[i] = mediaFromDB(dbMedia)
+	}
+	return Chirp{
+		ID:        dbChirp.ID,
+		AuthorID:  dbChirp.AuthorID,
+		Body:      dbChirp.Body,
+		InReplyTo: dbChirp.InReplyTo,
+		RootID:    dbChirp.RootID,
+		Entities:  dbChirp.Entities,
+		Media:     media,
+		CreatedAt: dbChirp.CreatedAt,
+		UpdatedAt: dbChirp.UpdatedAt,
+		Edited:    dbChirp.EditedAt != nil,
+		EditedAt:  dbChirp.EditedAt,
+		DeletedAt: dbChirp.DeletedAt,
+	}
+}
+
+// fills in the reply and reaction counts of chirps with one lookup each,
+// and whether the user of the request, if any, liked or rechirped them
+func (a *apiConfig) setCounts(r *http.Request, chirps []Chirp) error {
+	ids := make([]int, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+
+	replyCounts, err := a.DB.GetReplyCounts(ids)
+	if err != nil {
+		return err
+	}
+
+	userID := a.requestUser(r)
+	reactionCounts, err := a.DB.GetReactionCounts(ids, userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range chirps {
+		chirp := &chirps[i]
+		chirp.ReplyCount = replyCounts[chirp.ID]
+		reactions := reactionCounts[chirp.ID]
+		chirp.Likes = reactions.Likes
+		chirp.Rechirps = reactions.Rechirps
+		if userID != 0 {
+			chirp.LikedByMe = &reactions.LikedByMe
+			chirp.RechirpedByMe = &reactions.RechirpedByMe
+		}
+	}
+	return nil
 }
 
 func (a *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Body string `json:"body"`
+		Body      string `json:"body"`
+		InReplyTo int    `json:"in_reply_to"`
+		MediaIDs  []int  `json:"media_ids"`
+		// publishes the chirp later instead of right away
+		PublishAt *time.Time `json:"publish_at"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
@@ -53,17 +135,59 @@ func (a *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chirp, err := a.DB.CreateChirp(cleaned, userID)
+	if len(params.MediaIDs) > MEDIA_MAX_PER_CHIRP {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("a chirp can carry at most %d media", MEDIA_MAX_PER_CHIRP))
+		return
+	}
+
+	if params.PublishAt != nil {
+		if !params.PublishAt.After(time.Now()) {
+			utils.RespondWithError(w, http.StatusBadRequest, "publish_at must be in the future")
+			return
+		}
+
+		scheduled, err := a.DB.ScheduleChirp(cleaned, userID, params.InReplyTo, params.MediaIDs, *params.PublishAt)
+		if err != nil {
+			respondWithCreateChirpError(w, err, "could not schedule chirp")
+			return
+		}
+
+		a.wakeScheduler()
+		utils.RespondWithJSON(w, http.StatusCreated, scheduledChirpFromDB(scheduled))
+		return
+	}
+
+	var chirp database.Chirp
+	if params.InReplyTo != 0 {
+		chirp, err = a.DB.CreateReply(cleaned, userID, params.InReplyTo, params.MediaIDs)
+	} else {
+		chirp, err = a.DB.CreateChirp(cleaned, userID, params.MediaIDs)
+	}
 	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "could not create chirp")
+		respondWithCreateChirpError(w, err, "could not create chirp")
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusCreated, Chirp{
-		ID:       chirp.ID,
-		AuthorID: chirp.AuthorID,
-		Body:     chirp.Body,
-	})
+	utils.RespondWithJSON(w, http.StatusCreated, chirpFromDB(chirp))
+}
+
+// maps the errors of creating or scheduling a chirp,
+// anything unexpected is answered with msg
+func respondWithCreateChirpError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, database.ErrNotExist) {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find the chirp to reply to")
+		return
+	}
+	if errors.Is(err, database.ErrReplyToDeleted) {
+		utils.RespondWithError(w, http.StatusGone, "the chirp to reply to was deleted")
+		return
+	}
+	if errors.Is(err, database.ErrMediaUnavailable) {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	utils.RespondWithError(w, http.StatusInternalServerError, msg)
 }
 
 // func validateChirp(body string) (string, error) {
@@ -82,12 +206,7 @@ func (a *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request) {
 // }
 
 func (a *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
-	dbChirps, err := a.DB.GetChirps()
-	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve chirps")
-		return
-	}
-
+	var err error
 	authorID := -1
 	authorIDString := r.URL.Query().Get("author_id")
 	if authorIDString != "" {
@@ -98,35 +217,102 @@ func (a *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// the author index spares scanning everybody's chirps
+	var dbChirps []database.Chirp
+	if authorID != -1 {
+		dbChirps, err = a.DB.GetChirpsByAuthor(authorID)
+	} else {
+		dbChirps, err = a.DB.GetChirps()
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve chirps")
+		return
+	}
+
+	a.respondWithChirps(w, r, dbChirps)
+}
+
+// filters, sorts and paginates dbChirps by the since, until, sort and
+// page query parameters shared by all chirp listings
+func (a *apiConfig) respondWithChirps(w http.ResponseWriter, r *http.Request, dbChirps []database.Chirp) {
+	// optional RFC 3339 time range on created_at, since inclusive, until exclusive
+	since, err := parseTimeParam(r, "since")
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid since, expected RFC 3339")
+		return
+	}
+	until, err := parseTimeParam(r, "until")
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid until, expected RFC 3339")
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	sortDirection := "asc"
 	sortDirectionParam := r.URL.Query().Get("sort")
 	if sortDirectionParam == "desc" {
 		sortDirection = "desc"
 	}
+	desc := sortDirection == "desc"
+
+	if page.cursor != nil && page.cursor.Desc != desc {
+		utils.RespondWithError(w, http.StatusBadRequest, "cursor belongs to the other sort direction")
+		return
+	}
 
 	chirps := []Chirp{}
 	for _, dbChirp := range dbChirps {
-		if authorID != -1 && dbChirp.AuthorID != authorID {
+		if !since.IsZero() && dbChirp.CreatedAt.Before(since) {
 			continue
 		}
-
-		chirps = append(chirps, Chirp{
-			ID:       dbChirp.ID,
-			AuthorID: dbChirp.AuthorID,
-			Body:     dbChirp.Body,
-		})
+		if !until.IsZero() && !dbChirp.CreatedAt.Before(until) {
+			continue
+		}
+		chirps = append(chirps, chirpFromDB(dbChirp))
 	}
 
+	// by creation time, chirps created at the same time by ID
 	sort.Slice(chirps, func(i, j int) bool {
-		if sortDirection == "desc" {
-			return chirps[i].ID > chirps[j].ID
+		if desc {
+			i, j = j, i
 		}
-		return chirps[i].ID < chirps[j].ID
+		return chirpKeyBefore(chirps[i].CreatedAt, chirps[i].ID, chirps[j].CreatedAt, chirps[j].ID)
 	})
 
+	chirps, more := paginate(chirps, page, func(chirp Chirp) bool {
+		if desc {
+			return chirpKeyBefore(chirp.CreatedAt, chirp.ID, page.cursor.CreatedAt, page.cursor.ID)
+		}
+		return chirpKeyBefore(page.cursor.CreatedAt, page.cursor.ID, chirp.CreatedAt, chirp.ID)
+	})
+	if more {
+		last := chirps[len(chirps)-1]
+		setNextPage(w, r, pageCursor{CreatedAt: last.CreatedAt, ID: last.ID, Desc: desc})
+	}
+
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
 	utils.RespondWithJSON(w, http.StatusOK, chirps)
 }
 
+// reports whether the chirp created at createdAt with id
+// sorts before the one created at otherCreatedAt with otherID
+func chirpKeyBefore(createdAt time.Time, id int, otherCreatedAt time.Time, otherID int) bool {
+	if !createdAt.Equal(otherCreatedAt) {
+		return createdAt.Before(otherCreatedAt)
+	}
+	return id < otherID
+}
+
 func (a *apiConfig) getChirpByIdHandler(w http.ResponseWriter, r *http.Request) {
 	const matchingPattern string = "chirpID"
 	chirpIDString := r.PathValue(matchingPattern)
@@ -142,11 +328,19 @@ func (a *apiConfig) getChirpByIdHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, Chirp{
-		ID:       dbChirp.ID,
-		AuthorID: dbChirp.AuthorID,
-		Body:     dbChirp.Body,
-	})
+	if dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+		return
+	}
+
+	chirps := []Chirp{chirpFromDB(dbChirp)}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, chirps[0])
 }
 
 func (a *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request) {
@@ -187,6 +381,13 @@ func (a *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusGone, "chirp was already deleted")
+		return
+	}
+
+	// moves the chirp to the trash, see restoreChirpHandler.
+	// Replies stay, threads show the chirp as deleted
 	err = a.DB.DeleteChirp(chirpID)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "could not delete chirp")
@@ -195,3 +396,219 @@ func (a *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// replaces the body of a chirp of the authenticated user,
+// within the edit window after it was created.
+// The previous body stays readable as a revision
+func (a *apiConfig) editChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	const matchingPattern string = "chirpID"
+	chirpIDString := r.PathValue(matchingPattern)
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid chirp id")
+		return
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not decode parameters")
+		return
+	}
+
+	cleaned, err := utils.ValidateChirp(params.Body)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbChirp, err := a.DB.GetChirpByID(chirpID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+		return
+	}
+
+	if dbChirp.AuthorID != userID {
+		utils.RespondWithError(w, http.StatusForbidden, "you cannot edit this chirp")
+		return
+	}
+
+	if dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+		return
+	}
+
+	if a.editWindow > 0 && time.Since(dbChirp.CreatedAt) > a.editWindow {
+		utils.RespondWithError(w, http.StatusForbidden, "chirp can no longer be edited")
+		return
+	}
+
+	edited, err := a.DB.EditChirp(chirpID, cleaned)
+	if errors.Is(err, database.ErrChirpDeleted) {
+		// deleted concurrently
+		utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not edit chirp")
+		return
+	}
+
+	chirps := []Chirp{chirpFromDB(edited)}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, chirps[0])
+}
+
+// lists every version of a chirp body, the original first
+func (a *apiConfig) getRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "chirpID"
+	chirpIDString := r.PathValue(matchingPattern)
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid chirp id")
+		return
+	}
+
+	dbChirp, err := a.DB.GetChirpByID(chirpID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+		return
+	}
+
+	if dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+		return
+	}
+
+	revisions, err := a.DB.GetRevisions(chirpID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve revisions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, revisions)
+}
+
+// lists the chirps the authenticated user deleted
+// that can still be restored, newest deletion first
+func (a *apiConfig) getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	dbChirps, err := a.DB.GetDeletedChirps(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve trash")
+		return
+	}
+
+	chirps := []Chirp{}
+	for _, dbChirp := range dbChirps {
+		if a.trashExpired(dbChirp) {
+			continue
+		}
+		chirps = append(chirps, chirpFromDB(dbChirp))
+	}
+
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].DeletedAt.After(*chirps[j].DeletedAt)
+	})
+
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, chirps)
+}
+
+// takes a deleted chirp of the authenticated user back out of the trash,
+// as long as its retention window has not passed
+func (a *apiConfig) restoreChirpHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "chirpID"
+	chirpIDString := r.PathValue(matchingPattern)
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid chirp id")
+		return
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	dbChirp, err := a.DB.GetChirpByID(chirpID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+		return
+	}
+
+	if dbChirp.AuthorID != userID {
+		utils.RespondWithError(w, http.StatusForbidden, "you cannot restore this chirp")
+		return
+	}
+
+	if !dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusConflict, "chirp is not deleted")
+		return
+	}
+
+	if a.trashExpired(dbChirp) {
+		utils.RespondWithError(w, http.StatusGone, "chirp can no longer be restored")
+		return
+	}
+
+	restored, err := a.DB.RestoreChirp(chirpID)
+	if errors.Is(err, database.ErrNotExist) {
+		// restored or purged concurrently
+		utils.RespondWithError(w, http.StatusConflict, "chirp is not deleted")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not restore chirp")
+		return
+	}
+
+	chirps := []Chirp{chirpFromDB(restored)}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, chirps[0])
+}
+
+// parses the optional RFC 3339 query parameter name,
+// the zero time.Time when it is not set
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// reports whether a deleted chirp is past the trash retention window
+// and only waits for the purger to remove it
+func (a *apiConfig) trashExpired(dbChirp database.Chirp) bool {
+	return time.Since(*dbChirp.DeletedAt) > a.trashRetention
+}
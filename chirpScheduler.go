@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// how long the scheduler sleeps at most between looking for due chirps,
+// so a jumping wall clock can not delay chirps for long
+const SCHEDULER_MAX_WAIT time.Duration = time.Minute
+
+// Publishes scheduled chirps once they are due, until ctx is done.
+// Pending chirps live in the database, so after a restart the scheduler
+// picks them up again and publishes those it missed right away.
+// It sleeps until the next PublishAt and is woken early by wakeScheduler()
+// whenever a chirp is scheduled or rescheduled.
+// The number of published chirps is added to apiConfig.publishedChirps
+// and shown on the metrics page
+func (a *apiConfig) runChirpScheduler(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-a.schedulerWake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		published, err := a.DB.PublishDueChirps(time.Now())
+		if err != nil {
+			log.Printf("could not publish scheduled chirps: %s", err)
+		}
+		a.publishedChirps.Add(int64(published))
+
+		wait := SCHEDULER_MAX_WAIT
+		next, err := a.DB.NextPublishAt()
+		if err != nil {
+			log.Printf("could not read next scheduled chirp: %s", err)
+		}
+		if !next.IsZero() {
+			wait = min(wait, max(time.Until(next), 0))
+		}
+		timer.Reset(wait)
+	}
+}
+
+// makes the scheduler look at the scheduled chirps again,
+// never blocks as one pending wake up covers every change
+func (a *apiConfig) wakeScheduler() {
+	select {
+	case a.schedulerWake <- struct{}{}:
+	default:
+	}
+}
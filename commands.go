@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/joho/godotenv"
+)
+
+// CLI subcommands, run as `chirpy <command> [flags]` instead of the server
+var commands = map[string]func(args []string) error{
+	"migrate": migrateCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"crypt":   cryptCommand,
+}
+
+// reports pending schema migrations of the chosen backend,
+// and applies them with --apply
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	backend := flags.String("db", BACKEND_JSON, "Storage backend: json or sqlite")
+	apply := flags.Bool("apply", false, "Apply pending migrations")
+	flags.Parse(args)
+
+	path := FILE_DATABASE_PATH
+	pendingMigrations := database.PendingMigrations
+	if *backend == BACKEND_SQLITE {
+		path = FILE_SQLITE_PATH
+		pendingMigrations = database.PendingSQLiteMigrations
+	}
+
+	pending, err := pendingMigrations(path, encryptionOptions())
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("%s is up to date\n", path)
+		return nil
+	}
+
+	fmt.Printf("%s has %d pending migrations:\n", path, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  %3d  %s\n", m.Version, m.Name)
+	}
+
+	if !*apply {
+		fmt.Println("run with --apply to apply them")
+		return nil
+	}
+
+	// opening the store applies all pending migrations
+	db, err := openStore(*backend, encryptionOptions())
+	if err != nil {
+		return err
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s migrated\n", path)
+	return nil
+}
+
+// Writes a compressed snapshot of the chosen backend to --out, or stdout.
+// The database is only read, never migrated, re-keyed or created
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	backend := flags.String("db", BACKEND_JSON, "Storage backend: json or sqlite")
+	out := flags.String("out", "", "Archive file to write, stdout if empty")
+	flags.Parse(args)
+
+	var backup func(w io.Writer) error
+	switch *backend {
+	case BACKEND_JSON:
+		backup = func(w io.Writer) error {
+			return database.BackupFile(FILE_DATABASE_PATH, encryptionOptions(), w)
+		}
+	case BACKEND_SQLITE:
+		backup = func(w io.Writer) error {
+			return database.BackupSQLiteFile(FILE_SQLITE_PATH, database.Options{}, w)
+		}
+	default:
+		return fmt.Errorf("unknown database backend %q", *backend)
+	}
+
+	if *out == "" {
+		return backup(os.Stdout)
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = backup(file)
+	if err != nil {
+		file.Close()
+		os.Remove(*out)
+		return err
+	}
+	return file.Close()
+}
+
+// replaces all data of the chosen backend with the archive at --in, or stdin
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	backend := flags.String("db", BACKEND_JSON, "Storage backend: json or sqlite")
+	in := flags.String("in", "", "Archive file to read, stdin if empty")
+	flags.Parse(args)
+
+	db, err := openStore(*backend, encryptionOptions())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *in == "" {
+		return db.Restore(os.Stdin)
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return db.Restore(file)
+}
+
+// Re-encrypts the JSON-DB files with DB_ENCRYPTION_KEY, or decrypts
+// them with --decrypt. Reads with DB_ENCRYPTION_KEY and
+// DB_ENCRYPTION_KEY_PREVIOUS. Run it while the server is stopped
+func cryptCommand(args []string) error {
+	flags := flag.NewFlagSet("crypt", flag.ExitOnError)
+	path := flags.String("file", FILE_DATABASE_PATH, "JSON database to rewrite, with its .bak and .wal")
+	decrypt := flags.Bool("decrypt", false, "Write plain JSON instead of re-encrypting")
+	flags.Parse(args)
+
+	from := encryptionOptions()
+	to := database.Options{EncryptionKey: from.EncryptionKey}
+	if *decrypt {
+		to.EncryptionKey = ""
+	} else if to.EncryptionKey == "" {
+		return errors.New("DB_ENCRYPTION_KEY is not set, use --decrypt to write plain JSON")
+	}
+
+	err := database.RecryptFiles(*path, from, to)
+	if err != nil {
+		return err
+	}
+
+	if *decrypt {
+		fmt.Printf("%s decrypted\n", *path)
+	} else {
+		fmt.Printf("%s encrypted with the current key\n", *path)
+	}
+	return nil
+}
+
+// runs the subcommand named in os.Args, if any.
+// Reports whether one was found
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		return false
+	}
+
+	// commands read DB_ENCRYPTION_KEY and friends like the server does
+	godotenv.Load(".env")
+
+	err := command(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// lists the chirps using the hashtag in the path, with or without
+// its #, ignoring case. Takes the filters of GET /api/chirps
+func (a *apiConfig) getTagChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "tag"
+	tag := database.TagKey(r.PathValue(matchingPattern))
+	if tag == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid tag")
+		return
+	}
+
+	dbChirps, err := a.DB.GetChirpsByTag(tag)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve chirps")
+		return
+	}
+
+	a.respondWithChirps(w, r, dbChirps)
+}
+
+// lists the chirps mentioning the user in the path.
+// Takes the filters of GET /api/chirps
+func (a *apiConfig) getMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "userID"
+	userID, err := strconv.Atoi(r.PathValue(matchingPattern))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	_, err = a.DB.GetUserByID(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find user")
+		return
+	}
+
+	dbChirps, err := a.DB.GetMentions(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve mentions")
+		return
+	}
+
+	a.respondWithChirps(w, r, dbChirps)
+}
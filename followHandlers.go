@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// lets the authenticated user follow the user in the path.
+// Following a user twice is not an error and keeps the original follow
+func (a *apiConfig) followUserHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "userID"
+	followeeID, err := strconv.Atoi(r.PathValue(matchingPattern))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	follow, err := a.DB.FollowUser(userID, followeeID)
+	if err != nil {
+		if errors.Is(err, database.ErrSelfFollow) {
+			utils.RespondWithError(w, http.StatusBadRequest, "you cannot follow yourself")
+			return
+		}
+		if errors.Is(err, database.ErrNotExist) {
+			utils.RespondWithError(w, http.StatusNotFound, "could not find user")
+			return
+		}
+
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not follow user")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, follow)
+}
+
+// lets the authenticated user stop following the user in the path
+func (a *apiConfig) unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "userID"
+	followeeID, err := strconv.Atoi(r.PathValue(matchingPattern))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = a.DB.UnfollowUser(userID, followeeID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not unfollow user")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lists the users following the user in the path, paginated by follower ID
+func (a *apiConfig) getFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	a.respondWithFollows(w, r, a.DB.GetFollowers, func(follow database.Follow) int {
+		return follow.FollowerID
+	})
+}
+
+// lists the users the user in the path follows, paginated by followee ID
+func (a *apiConfig) getFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	a.respondWithFollows(w, r, a.DB.GetFollowing, func(follow database.Follow) int {
+		return follow.FolloweeID
+	})
+}
+
+// reads the follows of the user in the path with getFollows
+// and responds with them sorted and paginated by otherID
+func (a *apiConfig) respondWithFollows(w http.ResponseWriter, r *http.Request, getFollows func(int) ([]database.Follow, error), otherID func(database.Follow) int) {
+	const matchingPattern string = "userID"
+	userID, err := strconv.Atoi(r.PathValue(matchingPattern))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = a.DB.GetUserByID(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find user")
+		return
+	}
+
+	follows, err := getFollows(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve follows")
+		return
+	}
+
+	sort.Slice(follows, func(i, j int) bool {
+		return otherID(follows[i]) < otherID(follows[j])
+	})
+
+	follows, more := paginate(follows, page, func(follow database.Follow) bool {
+		return otherID(follow) > page.cursor.ID
+	})
+	if more {
+		setNextPage(w, r, pageCursor{ID: otherID(follows[len(follows)-1])})
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, follows)
+}
+
+// the home timeline of the authenticated user: the chirps of
+// everybody they follow, with the filters of GET /api/chirps
+func (a *apiConfig) getTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	dbChirps, err := a.DB.GetTimeline(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve timeline")
+		return
+	}
+
+	a.respondWithChirps(w, r, dbChirps)
+}
@@ -3,7 +3,8 @@ module github.com/Katalcha/go-chirpy
 go 1.22.2
 
 require (
-	golang.org/x/crypto v0.23.0
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.23.0
 )
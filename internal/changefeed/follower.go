@@ -0,0 +1,98 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// Keeps derived data over the visible chirps, like the search index
+// or the trends, in sync with the change feed of a database.Store.
+// reset replaces the derived data with a full load,
+// apply updates it with one event of the feed
+type Follower struct {
+	// names the derived data in log messages
+	name   string
+	reset  func(chirps []database.Chirp)
+	apply  func(event database.Event)
+	resync chan struct{}
+}
+
+func NewFollower(name string, reset func(chirps []database.Chirp), apply func(event database.Event)) *Follower {
+	return &Follower{
+		name:   name,
+		reset:  reset,
+		apply:  apply,
+		resync: make(chan struct{}, 1),
+	}
+}
+
+// Keeps the derived data in sync with store until ctx is done: loads
+// every visible chirp, then follows the change feed of store.
+// Subscribing happens before loading, and every event carries the full
+// new state of its chirp, so changes racing the load are applied again
+// afterwards instead of being missed.
+// When the subscription is dropped, or Resync() is called after the
+// data was replaced wholesale, it is rebuilt the same way
+func (f *Follower) Sync(ctx context.Context, store database.Store) error {
+	for {
+		sub, err := store.Subscribe(database.FromNow)
+		if err != nil {
+			return err
+		}
+
+		chirps, err := store.GetChirps()
+		if err != nil {
+			sub.Close()
+			return err
+		}
+		f.reset(chirps)
+
+		err = f.follow(ctx, sub)
+		sub.Close()
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("rebuilding %s", f.name)
+	}
+}
+
+// Asks Sync() to rebuild, for changes that bypass
+// the change feed like database.Store.Restore()
+func (f *Follower) Resync() {
+	select {
+	case f.resync <- struct{}{}:
+	default:
+	}
+}
+
+// applies events until ctx is done, a resync is requested or the
+// subscription ends. Returns an error only if the subscription
+// ended for good, with the store closed
+func (f *Follower) follow(ctx context.Context, sub *database.Subscription) error {
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if sub.Err() == nil {
+					return errors.New("change feed was closed")
+				}
+				log.Printf("%s fell behind: %s", f.name, sub.Err())
+				return nil
+			}
+			f.apply(event)
+		case <-f.resync:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package changefeed
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// Sync loads the chirps, applies the feed on top and loads them
+// again when Resync() asks for it
+func TestFollowerSync(t *testing.T) {
+	store, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("could not open database: %s", err)
+	}
+	defer store.Close()
+	author, err := store.CreateUser("author@example.com", "hash")
+	if err != nil {
+		t.Fatalf("could not create author: %s", err)
+	}
+	_, err = store.CreateChirp("before sync", author.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create chirp: %s", err)
+	}
+
+	mu := &sync.Mutex{}
+	resets := []int{}
+	applied := []database.EventType{}
+	follower := NewFollower("test", func(chirps []database.Chirp) {
+		mu.Lock()
+		defer mu.Unlock()
+		resets = append(resets, len(chirps))
+	}, func(event database.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, event.Type)
+	})
+	// reports whether the follower got there within a second
+	waitFor := func(done func() bool) bool {
+		for range 100 {
+			mu.Lock()
+			ok := done()
+			mu.Unlock()
+			if ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- follower.Sync(ctx, store) }()
+
+	if !waitFor(func() bool { return len(resets) == 1 }) {
+		t.Fatal("Sync never loaded the chirps")
+	}
+	_, err = store.CreateChirp("while following", author.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create chirp: %s", err)
+	}
+	if !waitFor(func() bool { return len(applied) == 1 }) {
+		t.Fatal("Sync never applied the new chirp")
+	}
+	if applied[0] != database.EventChirpCreated {
+		t.Errorf("got event %s, want %s", applied[0], database.EventChirpCreated)
+	}
+
+	follower.Resync()
+	if !waitFor(func() bool { return len(resets) == 2 }) {
+		t.Fatal("Resync never rebuilt")
+	}
+	if resets[0] != 1 || resets[1] != 2 {
+		t.Errorf("got loads of %v chirps, want [1 2]", resets)
+	}
+
+	cancel()
+	err = <-stopped
+	if err != nil {
+		t.Errorf("Sync stopped with %s", err)
+	}
+}
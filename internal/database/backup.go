@@ -0,0 +1,648 @@
+package database
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrInvalidBackup = errors.New("invalid backup archive")
+var ErrArchiveTooLarge = errors.New("backup archive is too large")
+var ErrMigrationsPending = errors.New("database has pending migrations, run migrate --apply first")
+
+// maximum decompressed size of an archive, so a small upload
+// can not expand into gigabytes of JSON
+var maxArchiveSize int64 = 1 << 30
+
+/*
+	BACKUP ARCHIVE:
+	gzip compressed JSON of a DBStructure, including its schema_version.
+	Both backends read and write the same format,
+	so an archive of the JSON-DB can be restored into SQLite and vice versa.
+	Uploads are only recorded, their bytes stay in the blob store
+*/
+
+// compresses a marshalled DBStructure into w
+func writeArchive(w io.Writer, data []byte) error {
+	gz := gzip.NewWriter(w)
+	_, err := gz.Write(data)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Decompresses and validates an archive. Archives of an older schema
+// are migrated to the latest one, newer ones are rejected
+func readArchive(r io.Reader) (DBStructure, error) {
+	// read errors are wrapped as well, so callers can tell them apart
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	defer gz.Close()
+
+	// one byte past the limit tells a too large archive from one that fits exactly
+	limited := &io.LimitedReader{R: gz, N: maxArchiveSize + 1}
+	dbStructure := DBStructure{}
+	err = json.NewDecoder(limited).Decode(&dbStructure)
+	if limited.N == 0 {
+		return DBStructure{}, ErrArchiveTooLarge
+	}
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	err = migrateArchived(&dbStructure)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = dbStructure.validate()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+	return dbStructure, nil
+}
+
+// brings a DBStructure read outside of a DB to the latest schema,
+// in memory only
+func migrateArchived(tx *DBStructure) error {
+	if tx.SchemaVersion > latestSchemaVersion() {
+		return ErrSchemaTooNew
+	}
+	for _, m := range pendingJSONMigrations(tx.SchemaVersion) {
+		err := m.up(tx)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		tx.SchemaVersion = m.Version
+	}
+	return nil
+}
+
+// checks that map keys match the IDs they hold
+// and that no sequence lags behind an ID in use
+func (tx *DBStructure) validate() error {
+	for id, chirp := range tx.Chirps {
+		if id != chirp.ID {
+			return fmt.Errorf("chirp key %d holds id %d", id, chirp.ID)
+		}
+		if id > tx.Sequences.Chirps {
+			return fmt.Errorf("chirp %d is above sequence %d", id, tx.Sequences.Chirps)
+		}
+	}
+	users := make([]User, 0, len(tx.Users))
+	for id, user := range tx.Users {
+		if id != user.ID {
+			return fmt.Errorf("user key %d holds id %d", id, user.ID)
+		}
+		if id > tx.Sequences.Users {
+			return fmt.Errorf("user %d is above sequence %d", id, tx.Sequences.Users)
+		}
+		users = append(users, user)
+	}
+	err := checkUniqueEmails(users)
+	if err != nil {
+		return err
+	}
+	for token, refreshToken := range tx.RefreshTokens {
+		if token != refreshToken.Token {
+			return fmt.Errorf("refresh token key does not match its token")
+		}
+	}
+	for followerID, followees := range tx.Follows {
+		for followeeID := range followees {
+			_, followerOK := tx.Users[followerID]
+			_, followeeOK := tx.Users[followeeID]
+			if !followerOK || !followeeOK {
+				return fmt.Errorf("follow of user %d on user %d references a missing user", followerID, followeeID)
+			}
+		}
+	}
+	for _, kind := range []ReactionKind{ReactionLike, ReactionRechirp} {
+		for chirpID, users := range tx.reactions(kind) {
+			_, ok := tx.Chirps[chirpID]
+			if !ok {
+				return fmt.Errorf("%s of chirp %d references a missing chirp", kind, chirpID)
+			}
+			for userID := range users {
+				_, ok := tx.Users[userID]
+				if !ok {
+					return fmt.Errorf("%s of chirp %d references missing user %d", kind, chirpID, userID)
+				}
+			}
+		}
+	}
+	for chirpID, revisions := range tx.Revisions {
+		_, ok := tx.Chirps[chirpID]
+		if !ok {
+			return fmt.Errorf("revisions of chirp %d reference a missing chirp", chirpID)
+		}
+		for i, revision := range revisions {
+			if revision.ChirpID != chirpID || revision.Number != i+1 {
+				return fmt.Errorf("revision %d of chirp %d is out of order", i+1, chirpID)
+			}
+		}
+	}
+	keys := map[string]struct{}{}
+	for id, media := range tx.Media {
+		if id != media.ID {
+			return fmt.Errorf("media key %d holds id %d", id, media.ID)
+		}
+		if id > tx.Sequences.Media {
+			return fmt.Errorf("media %d is above sequence %d", id, tx.Sequences.Media)
+		}
+		_, ok := keys[media.Key]
+		if ok {
+			return fmt.Errorf("media %d reuses blob key %q", id, media.Key)
+		}
+		keys[media.Key] = struct{}{}
+		if media.ChirpID != 0 {
+			_, ok := tx.Chirps[media.ChirpID]
+			if !ok {
+				return fmt.Errorf("media %d references missing chirp %d", id, media.ChirpID)
+			}
+		}
+	}
+	reserved := map[int]struct{}{}
+	for id, scheduled := range tx.Scheduled {
+		if id != scheduled.ID {
+			return fmt.Errorf("scheduled chirp key %d holds id %d", id, scheduled.ID)
+		}
+		if id > tx.Sequences.Scheduled {
+			return fmt.Errorf("scheduled chirp %d is above sequence %d", id, tx.Sequences.Scheduled)
+		}
+		_, ok := tx.Users[scheduled.AuthorID]
+		if !ok {
+			return fmt.Errorf("scheduled chirp %d references missing user %d", id, scheduled.AuthorID)
+		}
+		for _, mediaID := range scheduled.MediaIDs {
+			_, ok := reserved[mediaID]
+			media, exists := tx.Media[mediaID]
+			if ok || !exists || media.ChirpID != 0 || media.OwnerID != scheduled.AuthorID {
+				return fmt.Errorf("scheduled chirp %d can not reserve media %d", id, mediaID)
+			}
+			reserved[mediaID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Streams a consistent, compressed snapshot of the JSON-DB to w.
+// The snapshot is taken under the read lock, the slow part of
+// compressing and sending it happens after the lock is released
+func (db *DB) Backup(w io.Writer) error {
+	data := []byte{}
+	err := db.View(func(tx *DBStructure) error {
+		var err error
+		data, err = json.Marshal(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeArchive(w, data)
+}
+
+// Writes a compressed snapshot of the JSON-DB at path to w without
+// opening a DB: nothing is migrated, re-encrypted, recovered or created,
+// so the files are left exactly as they are. The snapshot and its WAL
+// are read under the shared file lock, which a running server with
+// Options.Cache holds exclusively, so back that one up through the
+// admin endpoint instead. Fails if there is no file at path
+func BackupFile(path string, opts Options, w io.Writer) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := newKeyring(opts.EncryptionKey, opts.PreviousEncryptionKeys)
+	if err != nil {
+		return err
+	}
+	db := &DB{path: path, opts: opts, keys: keys}
+
+	data := []byte{}
+	err = withFileLock(lockPath(path), false, func() error {
+		dbStructure, err := db.loadDB()
+		if err != nil {
+			return err
+		}
+
+		wal, err := os.Open(db.walPath())
+		if err == nil {
+			defer wal.Close()
+			_, err = db.replayWAL(&dbStructure, wal)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		err = migrateArchived(&dbStructure)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(dbStructure)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeArchive(w, data)
+}
+
+// Validates the archive in r and atomically replaces all data of the
+// JSON-DB with it. LastLSN never moves backwards, so mutations logged
+// after the restore keep sorting after everything before it.
+// The event journal restarts empty: subscribers behind the restore
+// get ErrCursorExpired and have to resync
+func (db *DB) Restore(r io.Reader) error {
+	restored, err := readArchive(r)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err = db.flock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer db.flock.unlock()
+
+	current := db.cache
+	if current == nil {
+		dbStructure, err := db.loadDB()
+		if err != nil {
+			return err
+		}
+		current = &dbStructure
+	}
+	restored.LastLSN = max(restored.LastLSN, current.LastLSN)
+	restored.Events = nil
+	restored.EventsHorizon = restored.LastLSN
+	restored.buildIndexes()
+	restored.clock = db.opts.Clock
+
+	if db.cache == nil {
+		return db.writeDB(restored)
+	}
+
+	db.cache = &restored
+	db.unflushed = nil
+	if db.wal != nil {
+		return db.compactLocked()
+	}
+	db.dirty = true
+	return db.flushLocked()
+}
+
+// Streams a consistent, compressed snapshot of the SQLite database to w,
+// read inside a single transaction
+func (db *SQLiteDB) Backup(w io.Writer) error {
+	dbStructure := DBStructure{
+		SchemaVersion: latestSchemaVersion(),
+		Chirps:        map[int]Chirp{},
+		Users:         map[int]User{},
+		RefreshTokens: map[string]RefreshToken{},
+		Follows:       map[int]map[int]time.Time{},
+		Likes:         map[int]map[int]time.Time{},
+		Rechirps:      map[int]map[int]time.Time{},
+		Revisions:     map[int][]Revision{},
+		Media:         map[int]Media{},
+		Scheduled:     map[int]ScheduledChirp{},
+	}
+
+	err := db.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + sqliteChirpColumns + ` FROM chirps`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			chirp, err := scanChirp(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.Chirps[chirp.ID] = chirp
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT ` + sqliteUserColumns + ` FROM users`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.Users[user.ID] = user
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT token, user_id, expires_at FROM refresh_tokens`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			refreshToken := RefreshToken{}
+			err = rows.Scan(&refreshToken.Token, &refreshToken.UserID, &refreshToken.ExpiresAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.RefreshTokens[refreshToken.Token] = refreshToken
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT follower_id, followee_id, created_at FROM follows`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			follow := Follow{}
+			err = rows.Scan(&follow.FollowerID, &follow.FolloweeID, &follow.CreatedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if dbStructure.Follows[follow.FollowerID] == nil {
+				dbStructure.Follows[follow.FollowerID] = map[int]time.Time{}
+			}
+			dbStructure.Follows[follow.FollowerID][follow.FolloweeID] = follow.CreatedAt
+		}
+		rows.Close()
+
+		for kind, table := range reactionTables {
+			reactions := dbStructure.reactions(kind)
+			rows, err = tx.Query(`SELECT chirp_id, user_id, created_at FROM ` + table)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				reaction := Reaction{}
+				err = rows.Scan(&reaction.ChirpID, &reaction.UserID, &reaction.CreatedAt)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				if reactions[reaction.ChirpID] == nil {
+					reactions[reaction.ChirpID] = map[int]time.Time{}
+				}
+				reactions[reaction.ChirpID][reaction.UserID] = reaction.CreatedAt
+			}
+			rows.Close()
+		}
+
+		rows, err = tx.Query(`SELECT chirp_id, number, body, created_at FROM chirp_revisions ORDER BY chirp_id, number`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			revision := Revision{}
+			err = rows.Scan(&revision.ChirpID, &revision.Number, &revision.Body, &revision.CreatedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.Revisions[revision.ChirpID] = append(dbStructure.Revisions[revision.ChirpID], revision)
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT ` + sqliteMediaColumns + ` FROM media`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			media, err := scanMedia(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.Media[media.ID] = media
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT ` + sqliteScheduledColumns + ` FROM scheduled_chirps`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			scheduled, err := scanScheduled(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dbStructure.Scheduled[scheduled.ID] = scheduled
+		}
+		rows.Close()
+
+		rows, err = tx.Query(`SELECT name, seq FROM sqlite_sequence`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			name, seq := "", 0
+			err = rows.Scan(&name, &seq)
+			if err != nil {
+				return err
+			}
+			switch name {
+			case "chirps":
+				dbStructure.Sequences.Chirps = seq
+			case "users":
+				dbStructure.Sequences.Users = seq
+			case "media":
+				dbStructure.Sequences.Media = seq
+			case "scheduled_chirps":
+				dbStructure.Sequences.Scheduled = seq
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+	return writeArchive(w, data)
+}
+
+// Writes a compressed snapshot of the SQLite database at path to w,
+// reading it through a read-only connection: nothing is migrated or
+// created. Fails if there is no file at path or if it has pending
+// migrations, see PendingSQLiteMigrations()
+func BackupSQLiteFile(path string, opts Options, w io.Writer) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	version, err := sqliteUserVersion(conn)
+	if err != nil {
+		return err
+	}
+	latest := sqliteMigrations[len(sqliteMigrations)-1].Version
+	if version > latest {
+		return ErrSchemaTooNew
+	}
+	if version < latest {
+		return ErrMigrationsPending
+	}
+
+	db := &SQLiteDB{path: path, conn: conn, opts: opts}
+	return db.Backup(w)
+}
+
+// Validates the archive in r and replaces all data of the SQLite
+// database with it in a single transaction.
+// Subscribers behind the restore get ErrCursorExpired
+func (db *SQLiteDB) Restore(r io.Reader) error {
+	restored, err := readArchive(r)
+	if err != nil {
+		return err
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	return db.withTx(func(tx *sql.Tx) error {
+		// like the JSON-DB, the event journal restarts empty
+		for _, table := range []string{"events", "scheduled_media", "scheduled_chirps", "media", "chirp_tags", "chirp_mentions", "chirp_revisions", "likes", "rechirps", "follows", "refresh_tokens", "chirps", "users"} {
+			_, err := tx.Exec(`DELETE FROM ` + table)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, user := range restored.Users {
+			_, err := tx.Exec(
+				`INSERT INTO users (`+sqliteUserColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+				user.ID, user.Email, user.HashedPassword, user.IsChirpyRed, user.CreatedAt.UTC(), user.UpdatedAt.UTC(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		for _, chirp := range restored.Chirps {
+			entities, err := jsonColumn(chirp.Entities)
+			if err != nil {
+				return err
+			}
+			media, err := jsonColumn(chirp.Media)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`INSERT INTO chirps (`+sqliteChirpColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				chirp.ID, chirp.AuthorID, chirp.Body, nullableID(chirp.InReplyTo), nullableID(chirp.RootID), entities, media,
+				chirp.CreatedAt.UTC(), chirp.UpdatedAt.UTC(), chirp.EditedAt, chirp.DeletedAt,
+			)
+			if err != nil {
+				return err
+			}
+			err = writeEntities(tx, chirp)
+			if err != nil {
+				return err
+			}
+		}
+		for _, refreshToken := range restored.RefreshTokens {
+			_, err := tx.Exec(
+				`INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`,
+				refreshToken.Token, refreshToken.UserID, refreshToken.ExpiresAt.UTC(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		for followerID, followees := range restored.Follows {
+			for followeeID, createdAt := range followees {
+				_, err := tx.Exec(
+					`INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`,
+					followerID, followeeID, createdAt.UTC(),
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for kind, table := range reactionTables {
+			for chirpID, users := range restored.reactions(kind) {
+				for userID, createdAt := range users {
+					_, err := tx.Exec(
+						`INSERT INTO `+table+` (chirp_id, user_id, created_at) VALUES (?, ?, ?)`,
+						chirpID, userID, createdAt.UTC(),
+					)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		for _, revisions := range restored.Revisions {
+			for _, revision := range revisions {
+				_, err := tx.Exec(
+					`INSERT INTO chirp_revisions (chirp_id, number, body, created_at) VALUES (?, ?, ?, ?)`,
+					revision.ChirpID, revision.Number, revision.Body, revision.CreatedAt.UTC(),
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, media := range restored.Media {
+			_, err := tx.Exec(
+				`INSERT INTO media (`+sqliteMediaColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				media.ID, media.OwnerID, nullableID(media.ChirpID), media.Key, media.ContentType, media.Size, media.CreatedAt.UTC(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, scheduled := range restored.Scheduled {
+			scheduled.PublishAt = scheduled.PublishAt.UTC()
+			scheduled.CreatedAt = scheduled.CreatedAt.UTC()
+			scheduled.UpdatedAt = scheduled.UpdatedAt.UTC()
+			err := insertScheduled(tx, &scheduled)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name IN ('chirps', 'users', 'media', 'scheduled_chirps')`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO sqlite_sequence (name, seq) VALUES ('chirps', ?), ('users', ?), ('media', ?), ('scheduled_chirps', ?)`,
+			restored.Sequences.Chirps, restored.Sequences.Users, restored.Sequences.Media, restored.Sequences.Scheduled,
+		)
+		return err
+	})
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// backing up must neither create a missing database nor touch an existing one
+func TestBackupFileIsReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.json")
+	err := BackupFile(missing, Options{}, &bytes.Buffer{})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v for a missing database, want os.ErrNotExist", err)
+	}
+	_, err = os.Stat(missing)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup created %s", missing)
+	}
+
+	path := filepath.Join(dir, "database.json")
+	db, err := NewDBWithOptions(path, Options{WAL: true})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err)
+	}
+	author, err := db.CreateUser("author@example.com", "hash")
+	if err != nil {
+		t.Fatalf("could not create author: %s", err)
+	}
+	// only in the WAL until the next compaction
+	_, err = db.CreateChirp("logged", author.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create chirp: %s", err)
+	}
+	err = db.wal.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cached DB holds the exclusive lock, release it like a stopped server
+	db.flock.unlock()
+
+	before := readFiles(t, path, db.walPath())
+	archive := &bytes.Buffer{}
+	err = BackupFile(path, Options{}, archive)
+	if err != nil {
+		t.Fatalf("could not back up: %s", err)
+	}
+	if !bytes.Equal(before, readFiles(t, path, db.walPath())) {
+		t.Error("backup changed the database files")
+	}
+
+	restored, err := readArchive(archive)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err)
+	}
+	if len(restored.Chirps) != 1 || len(restored.Users) != 1 {
+		t.Errorf("got %d chirps and %d users, want the logged chirp and its author", len(restored.Chirps), len(restored.Users))
+	}
+}
+
+func readFiles(t *testing.T, paths ...string) []byte {
+	t.Helper()
+	data := []byte{}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, content...)
+	}
+	return data
+}
+
+// archives expanding past maxArchiveSize are rejected while decompressing
+func TestReadArchiveRejectsOversized(t *testing.T) {
+	defer func(size int64) { maxArchiveSize = size }(maxArchiveSize)
+	maxArchiveSize = 1 << 10
+
+	archive := &bytes.Buffer{}
+	gz := gzip.NewWriter(archive)
+	_, err := gz.Write([]byte(`{"chirps": {}, "padding": "` + strings.Repeat("a", 1<<20) + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	_, err = readArchive(archive)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("got %v, want ErrArchiveTooLarge", err)
+	}
+}
+
+// a body cut off by http.MaxBytesReader stays recognizable for the restore handler
+func TestReadArchiveKeepsReadErrors(t *testing.T) {
+	archive := &bytes.Buffer{}
+	gz := gzip.NewWriter(archive)
+	_, err := gz.Write([]byte(`{"chirps": {}, "padding": "` + strings.Repeat("a", 1<<20) + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	body := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(archive), 64)
+	_, err = readArchive(body)
+	if !errors.As(err, new(*http.MaxBytesError)) {
+		t.Errorf("got %v, want a *http.MaxBytesError", err)
+	}
+}
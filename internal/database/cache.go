@@ -0,0 +1,162 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Reads the JSON-DB from disk into the resident cache
+func (db *DB) loadCache() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	db.cache = &dbStructure
+	db.dirty = false
+	db.unflushed = nil
+	return nil
+}
+
+// Applies fn to the resident cache and persists the result,
+// by appending it to the WAL, writing it through right away
+// or on the next tick of DB.persistLoop().
+// If fn fails after applying changes, or the WAL append or the
+// write-through fails, the cache is rolled back to what is persisted
+// plus the batched changes not flushed yet, so reads never see a change
+// that did not commit. Batched changes that fail to flush stay dirty
+// and are retried by the next Flush.
+// Callers must hold db.mu for writing
+func (db *DB) updateCache(fn func(tx *DBStructure) error) error {
+	sequences := db.cache.Sequences
+	lastLSN := db.cache.LastLSN
+	err := fn(db.cache)
+	entries := db.cache.pending
+	db.cache.pending = nil
+	if err != nil {
+		if db.cache.LastLSN == lastLSN {
+			// nothing was applied, fn may only have advanced a sequence
+			db.cache.Sequences = sequences
+		} else {
+			reloadErr := db.reloadCache()
+			if reloadErr != nil {
+				return errors.Join(err, fmt.Errorf("could not roll back cache: %w", reloadErr))
+			}
+		}
+		if errors.Is(err, errRollback) {
+			return nil
+		}
+		return err
+	}
+
+	if db.wal != nil {
+		err = db.appendWAL(entries)
+		if err != nil {
+			return db.rollbackCache(err)
+		}
+		db.publish(entries)
+		return nil
+	}
+
+	flushed := db.unflushed
+	db.unflushed = append(db.unflushed, entries...)
+	db.dirty = true
+	if db.opts.FlushInterval == 0 {
+		err = db.flushLocked()
+		if err != nil {
+			db.unflushed = flushed
+			return db.rollbackCache(err)
+		}
+	}
+
+	db.publish(entries)
+	return nil
+}
+
+// Rolls the cache back with reloadCache() after persisting
+// an Update failed with cause, and returns cause.
+// Callers must hold db.mu for writing
+func (db *DB) rollbackCache(cause error) error {
+	err := db.reloadCache()
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("could not roll back cache: %w", err))
+	}
+	return cause
+}
+
+// Replaces the cache with what is persisted, the snapshot and the WAL
+// if there is one, plus the batched changes not flushed yet.
+// Callers must hold db.mu for writing
+func (db *DB) reloadCache() error {
+	reloaded, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if db.wal != nil {
+		_, err = db.replayWAL(&reloaded, io.NewSectionReader(db.wal, 0, db.walSize))
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range db.unflushed {
+		if entry.LSN <= reloaded.LastLSN {
+			continue
+		}
+		err = reloaded.replay(entry)
+		if err != nil {
+			return fmt.Errorf("could not replay unflushed entry %d: %w", entry.LSN, err)
+		}
+	}
+	db.cache = &reloaded
+	db.dirty = len(db.unflushed) > 0
+	return nil
+}
+
+// Writes the resident cache to disk if it has unpersisted changes
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.flushLocked()
+}
+
+// Callers must hold db.mu for writing
+func (db *DB) flushLocked() error {
+	if db.cache == nil || !db.dirty {
+		return nil
+	}
+
+	err := db.writeDB(*db.cache)
+	if err != nil {
+		return err
+	}
+	db.dirty = false
+	db.unflushed = nil
+	return nil
+}
+
+// Background persister for batched writes.
+// Flushes every Options.FlushInterval until DB.Close() is called
+func (db *DB) persistLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := db.Flush()
+			if err != nil {
+				log.Printf("could not flush database %s: %s", db.path, err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
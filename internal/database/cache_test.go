@@ -0,0 +1,203 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var benchmarkSizes = []int{10_000, 100_000}
+
+// the modes compared by the benchmarks: reading the file on every call
+// against serving from the resident cache, written through on every Update
+var benchmarkModes = []struct {
+	name string
+	opts Options
+}{
+	{"disk", Options{}},
+	{"cache", Options{Cache: true}},
+}
+
+// opens a DB in opts holding size chirps of one author, seeded in one Update
+func openSeededDB(b *testing.B, opts Options, size int) (*DB, int) {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "database.json")
+	db, err := NewDBWithOptions(path, opts)
+	if err != nil {
+		b.Fatalf("could not open database: %s", err)
+	}
+
+	author, err := db.CreateUser("author@example.com", "hash")
+	if err != nil {
+		b.Fatalf("could not create author: %s", err)
+	}
+	err = db.Update(func(tx *DBStructure) error {
+		for i := range size {
+			chirp, err := tx.newChirp(fmt.Sprintf("chirp number %d", i), author.ID, 0, nil, 0)
+			if err != nil {
+				return err
+			}
+			err = tx.apply(walEntry{Op: opChirpCreated, Chirp: &chirp})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("could not seed chirps: %s", err)
+	}
+	return db, author.ID
+}
+
+func BenchmarkGetChirps(b *testing.B) {
+	for _, mode := range benchmarkModes {
+		for _, size := range benchmarkSizes {
+			b.Run(fmt.Sprintf("%s/%d", mode.name, size), func(b *testing.B) {
+				db, _ := openSeededDB(b, mode.opts, size)
+				defer db.Close()
+
+				b.ResetTimer()
+				for range b.N {
+					chirps, err := db.GetChirps()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(chirps) != size {
+						b.Fatalf("got %d chirps, want %d", len(chirps), size)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCreateChirp(b *testing.B) {
+	for _, mode := range benchmarkModes {
+		for _, size := range benchmarkSizes {
+			b.Run(fmt.Sprintf("%s/%d", mode.name, size), func(b *testing.B) {
+				db, authorID := openSeededDB(b, mode.opts, size)
+				defer db.Close()
+
+				b.ResetTimer()
+				for i := range b.N {
+					_, err := db.CreateChirp(fmt.Sprintf("benchmark chirp %d", i), authorID, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// an Update that fails after applying a chirp and advancing the sequence
+func failHalfway(db *DB, authorID int) error {
+	return db.Update(func(tx *DBStructure) error {
+		chirp, err := tx.newChirp("lost", authorID, 0, nil, 0)
+		if err != nil {
+			return err
+		}
+		err = tx.apply(walEntry{Op: opChirpCreated, Chirp: &chirp})
+		if err != nil {
+			return err
+		}
+		return errors.New("failed halfway")
+	})
+}
+
+// A write that fails to persist, or fails halfway, must not stay
+// visible in the cache. Batched changes not flushed yet survive it
+func TestFailedPersistRollsBackCache(t *testing.T) {
+	modes := map[string]struct {
+		opts Options
+		// fails to write a chirp with the body "lost"
+		failWrite func(t *testing.T, db *DB, authorID int) error
+	}{
+		"write-through": {Options{Cache: true}, func(t *testing.T, db *DB, authorID int) error {
+			// the snapshot is written to path.tmp first
+			err := os.Mkdir(db.path+".tmp", 0o700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateChirp("lost", authorID, nil)
+			return err
+		}},
+		"wal": {Options{WAL: true}, func(t *testing.T, db *DB, authorID int) error {
+			readOnly, err := os.Open(db.walPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.wal.Close()
+			db.wal = readOnly
+			_, err = db.CreateChirp("lost", authorID, nil)
+			return err
+		}},
+		"write-through halfway": {Options{Cache: true}, func(t *testing.T, db *DB, authorID int) error {
+			return failHalfway(db, authorID)
+		}},
+		"batched halfway": {Options{Cache: true, FlushInterval: time.Hour}, func(t *testing.T, db *DB, authorID int) error {
+			return failHalfway(db, authorID)
+		}},
+		"wal halfway": {Options{WAL: true}, func(t *testing.T, db *DB, authorID int) error {
+			return failHalfway(db, authorID)
+		}},
+	}
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), mode.opts)
+			if err != nil {
+				t.Fatalf("could not open database: %s", err)
+			}
+			defer db.Close()
+			author, err := db.CreateUser("author@example.com", "hash")
+			if err != nil {
+				t.Fatalf("could not create author: %s", err)
+			}
+			_, err = db.CreateChirp("persisted", author.ID, nil)
+			if err != nil {
+				t.Fatalf("could not create chirp: %s", err)
+			}
+
+			err = mode.failWrite(t, db, author.ID)
+			if err == nil {
+				t.Fatal("expected the write to fail")
+			}
+
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatalf("could not read chirps: %s", err)
+			}
+			if len(chirps) != 1 || chirps[0].Body != "persisted" {
+				t.Errorf("got chirps %v, want only the persisted one", chirps)
+			}
+			if db.cache.Sequences.Chirps != 1 {
+				t.Errorf("got chirp sequence %d, want 1", db.cache.Sequences.Chirps)
+			}
+		})
+	}
+}
+
+// A failed Update leaves no trace in memory when fn
+// fails before applying anything either
+func TestFailedUpdateRestoresSequences(t *testing.T) {
+	db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{Cache: true, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *DBStructure) error {
+		tx.nextChirpID()
+		return errors.New("failed before applying")
+	})
+	if err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if db.cache.Sequences.Chirps != 0 {
+		t.Errorf("got chirp sequence %d, want 0", db.cache.Sequences.Chirps)
+	}
+}
@@ -1,78 +1,303 @@
 package database
 
+import (
+	"errors"
+	"time"
+)
+
+var ErrReplyToDeleted = errors.New("can not reply to a deleted chirp")
+
+// CreatedAt and UpdatedAt are set by the database, from Options.Clock.
+// DeletedAt is set while the chirp sits in its author's trash,
+// see DB.DeleteChirp().
+// Replies point at the chirp they answer with InReplyTo and at the
+// chirp that started the thread with RootID, both are 0 otherwise.
+// EditedAt is set once the body was edited, see DB.EditChirp().
+// Entities are extracted from Body whenever it is written.
+// Media holds copies of the attached uploads, in the order given
 type Chirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
-}
-
-// Creates a Chirp by loading the whole JSON-DB in-memory,
-// determine and setting Chirp.ID by incrementing the length of all
-// saved Chirps by 1, setting Chirp.Body with provided string,
-// add new Chirp to in-memory DBStructure.Chirps and
-// write the updated in-memory JSON-DB back to disk via DB.writeDB()
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+	ID        int        `json:"id"`
+	AuthorID  int        `json:"author_id"`
+	Body      string     `json:"body"`
+	InReplyTo int        `json:"in_reply_to,omitempty"`
+	RootID    int        `json:"root_id,omitempty"`
+	Entities  []Entity   `json:"entities,omitempty"`
+	Media     []Media    `json:"media,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func (chirp Chirp) IsDeleted() bool {
+	return chirp.DeletedAt != nil
+}
+
+// Creates a Chirp inside a DB.Update() transaction by
+// taking the next Chirp.ID from DBStructure.Sequences, setting Chirp.Body with provided string and
+// add new Chirp to DBStructure.Chirps.
+// The uploads mediaIDs of the author are attached to it,
+// see DBStructure.checkChirp() for when that fails
+func (db *DB) CreateChirp(body string, authorID int, mediaIDs []int) (Chirp, error) {
+	return db.createChirp(body, authorID, 0, mediaIDs)
+}
+
+// Creates a Chirp replying to parentID, in the thread of parentID.
+// Returns ErrNotExist if the parent does not exist and
+// ErrReplyToDeleted if it is in the trash
+func (db *DB) CreateReply(body string, authorID, parentID int, mediaIDs []int) (Chirp, error) {
+	return db.createChirp(body, authorID, parentID, mediaIDs)
+}
+
+func (db *DB) createChirp(body string, authorID, parentID int, mediaIDs []int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		var err error
+		chirp, err = tx.newChirp(body, authorID, parentID, mediaIDs, 0)
+		if err != nil {
+			return err
+		}
+		return tx.apply(walEntry{Op: opChirpCreated, Chirp: &chirp})
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	id := len(dbStructure.Chirps) + 1
-	chirp := Chirp{
-		ID:       id,
-		AuthorID: authorID,
-		Body:     body,
+	return chirp, nil
+}
+
+// Checks that a chirp of authorID can reply to parentID and carry the
+// uploads mediaIDs, returning the root of the thread and the uploads.
+// Uploads reserved by the scheduled chirp scheduledID count as available
+func (tx *DBStructure) checkChirp(authorID, parentID int, mediaIDs []int, scheduledID int) (int, []Media, error) {
+	rootID := 0
+	if parentID != 0 {
+		parent, ok := tx.Chirps[parentID]
+		if !ok {
+			return 0, nil, ErrNotExist
+		}
+		if parent.IsDeleted() {
+			return 0, nil, ErrReplyToDeleted
+		}
+		rootID = parent.threadRoot()
 	}
-	dbStructure.Chirps[id] = chirp
+	media, err := tx.attachableMedia(mediaIDs, authorID, scheduledID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rootID, media, nil
+}
 
-	err = db.writeDB(dbStructure)
+// builds the next Chirp after checkChirp(), for opChirpCreated
+func (tx *DBStructure) newChirp(body string, authorID, parentID int, mediaIDs []int, scheduledID int) (Chirp, error) {
+	rootID, media, err := tx.checkChirp(authorID, parentID, mediaIDs, scheduledID)
 	if err != nil {
 		return Chirp{}, err
 	}
 
+	now := tx.now()
+	chirp := Chirp{
+		ID:        tx.nextChirpID(),
+		AuthorID:  authorID,
+		Body:      body,
+		InReplyTo: parentID,
+		RootID:    rootID,
+		Entities:  extractEntities(body, tx.userIDByEmail),
+		Media:     media,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for i := range chirp.Media {
+		chirp.Media[i].ChirpID = chirp.ID
+	}
 	return chirp, nil
 }
 
-// Reads all Chirps in JSON-DB by loading the whole DB in-memory
-// and append all Chirps in a []Chirp Slice
+// Reads all Chirps in JSON-DB inside a DB.View() transaction
+// and append all Chirps not in the trash in a []Chirp Slice
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		chirps = make([]Chirp, 0, len(tx.Chirps))
+		for _, chirp := range tx.Chirps {
+			if !chirp.IsDeleted() {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
+	return chirps, nil
+}
+
+// Reads all Chirps of one author via the author index,
+// without scanning the Chirps of everybody else
+func (db *DB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	return db.chirpsOfAuthor(authorID, false)
+}
+
+// Reads the trash of one author, the Chirps they deleted
+// that were not purged yet
+func (db *DB) GetDeletedChirps(authorID int) ([]Chirp, error) {
+	return db.chirpsOfAuthor(authorID, true)
+}
+
+func (db *DB) chirpsOfAuthor(authorID int, deleted bool) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, chirp := range tx.chirpsByAuthor(authorID) {
+			if chirp.IsDeleted() == deleted {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return chirps, nil
 }
 
-func (db *DB) GetChirpByID(id int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+// the ID of the chirp that started the thread of chirp
+func (chirp Chirp) threadRoot() int {
+	if chirp.RootID != 0 {
+		return chirp.RootID
+	}
+	return chirp.ID
+}
+
+// Reads the whole thread id belongs to, via the thread index: the chirp
+// that started it and all replies, deleted ones included.
+// Returns ErrNotExist if id does not exist
+func (db *DB) GetThread(id int) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		chirp, ok := tx.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+
+		rootID := chirp.threadRoot()
+		root, ok := tx.Chirps[rootID]
+		if ok {
+			chirps = append(chirps, root)
+		}
+		for replyID := range tx.idx.threads[rootID] {
+			chirps = append(chirps, tx.Chirps[replyID])
+		}
+		return nil
+	})
 	if err != nil {
-		return Chirp{}, err
+		return nil, err
+	}
+
+	return chirps, nil
+}
+
+// Counts the replies to each of ids that are not in the trash,
+// via the replies index. Chirps without replies are left out
+func (db *DB) GetReplyCounts(ids []int) (map[int]int, error) {
+	counts := map[int]int{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, id := range ids {
+			for replyID := range tx.idx.replies[id] {
+				if !tx.Chirps[replyID].IsDeleted() {
+					counts[id]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	chirp, ok := dbStructure.Chirps[id]
-	if !ok {
-		return Chirp{}, ErrNotExist
+	return counts, nil
+}
+
+// Reads one Chirp, deleted ones included,
+// callers decide what to do with Chirp.IsDeleted()
+func (db *DB) GetChirpByID(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		dbChirp, ok := tx.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+		chirp = dbChirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
+// Moves a Chirp to the trash of its author. It stays restorable
+// until DB.PurgeDeletedChirps() removes it for good
 func (db *DB) DeleteChirp(id int) error {
-	dbStructure, err := db.loadDB()
+	return db.Update(func(tx *DBStructure) error {
+		chirp, ok := tx.Chirps[id]
+		if !ok || chirp.IsDeleted() {
+			return errRollback
+		}
+		return tx.apply(walEntry{Op: opChirpTrashed, ID: id})
+	})
+}
+
+// Takes a Chirp back out of the trash.
+// Returns ErrNotExist if it is not in the trash
+func (db *DB) RestoreChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		dbChirp, ok := tx.Chirps[id]
+		if !ok || !dbChirp.IsDeleted() {
+			return ErrNotExist
+		}
+
+		chirp = dbChirp
+		chirp.DeletedAt = nil
+		return tx.apply(walEntry{Op: opChirpRestored, Chirp: &chirp})
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
 
-	delete(dbStructure.Chirps, id)
-	err = db.writeDB(dbStructure)
+	return chirp, nil
+}
+
+// Removes every Chirp that was deleted before the given time for good,
+// returning how many were removed
+func (db *DB) PurgeDeletedChirps(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		expired := []int{}
+		for id, chirp := range tx.Chirps {
+			if chirp.IsDeleted() && chirp.DeletedAt.Before(before) {
+				expired = append(expired, id)
+			}
+		}
+
+		for _, id := range expired {
+			err := tx.apply(walEntry{Op: opChirpDeleted, ID: id})
+			if err != nil {
+				return err
+			}
+			purged++
+		}
+		if purged == 0 {
+			return errRollback
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	return purged, nil
 }
@@ -3,24 +3,94 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var ErrNotExist = errors.New("resource does not exist")
+var ErrCorrupt = errors.New("database file is corrupt and no valid backup exists")
+
+// returned by an Update fn to discard its changes without failing the call
+var errRollback = errors.New("rollback")
 
 // represents the DB itself
+// cache, dirty, unflushed and the persister fields are only used with Options.Cache,
+// wal and walSize only with Options.WAL
 type DB struct {
 	path string
 	mu   *sync.RWMutex
+	opts Options
+
+	cache *DBStructure
+	dirty bool
+	// batched changes applied to cache since it was last written,
+	// replayed when the cache is rolled back
+	unflushed []walEntry
+	wal       *os.File
+	walSize   int64
+	events    *eventHub
+
+	// nil for plaintext storage, see encryption.go
+	keys *keyring
+	// cross-process lock on path.lock, see lock.go
+	flock *fileLock
+
+	done      chan struct{}
+	wg        *sync.WaitGroup
+	closeOnce *sync.Once
+}
+
+// tunes how a DB reads and persists its data
+type Options struct {
+	// keep DBStructure resident in memory and serve reads without I/O
+	Cache bool
+	// with Cache: 0 writes every Update through to disk,
+	// anything above batches changes and flushes them at this interval
+	FlushInterval time.Duration
+	// append every mutation to a write-ahead log instead of rewriting
+	// the snapshot. Implies Cache, FlushInterval is ignored
+	WAL bool
+	// WAL size in bytes after which it is compacted into a new snapshot,
+	// 0 uses a default of 4 MiB
+	WALCompactSize int64
+	// hex encoded 32 byte AES key to encrypt all files at rest,
+	// empty stores plain JSON
+	EncryptionKey string
+	// keys that are still accepted for reading while rotating
+	// to EncryptionKey, see encryption.go
+	PreviousEncryptionKeys []string
+	// source of created_at, updated_at and every other timestamp
+	// the database sets, nil uses time.Now. Meant for tests
+	Clock func() time.Time
 }
 
 // represents the contents of DB as map of Chirps and map of Users
 type DBStructure struct {
-	Chirps        map[int]Chirp           `json:"chirps"`
-	Users         map[int]User            `json:"users"`
-	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	SchemaVersion int                       `json:"schema_version"`
+	Chirps        map[int]Chirp             `json:"chirps"`
+	Users         map[int]User              `json:"users"`
+	RefreshTokens map[string]RefreshToken   `json:"refresh_tokens"`
+	Follows       map[int]map[int]time.Time `json:"follows"`
+	Likes         map[int]map[int]time.Time `json:"likes"`
+	Rechirps      map[int]map[int]time.Time `json:"rechirps"`
+	Revisions     map[int][]Revision        `json:"revisions"`
+	Media         map[int]Media             `json:"media"`
+	Scheduled     map[int]ScheduledChirp    `json:"scheduled"`
+	Sequences     Sequences                 `json:"sequences"`
+	LastLSN       int64                     `json:"last_lsn"`
+	Events        []Event                   `json:"events"`
+	EventsHorizon int64                     `json:"events_horizon"`
+
+	// mutations recorded by apply() during the current Update
+	pending []walEntry
+	// secondary indexes, see indexes.go
+	idx *indexes
+	// Options.Clock of the DB it was loaded by
+	clock func() time.Time
 }
 
 /*
@@ -29,93 +99,426 @@ type DBStructure struct {
 
 	INSIDE JSON:
 	{	<-- DBStructure struct
+		"schema_version": 2,	<-- DBStructure.SchemaVersion, see migrations.go
 		"chirps": {	<-- DBStructure.Chirps map[int]string
 			"1": { id: 1, body: "blabla" },		<-- Chirp struct
 			"2": { id: 2, body: "blublub" },	<-- Chirp struct
+			"3": { id: 3, body: "re", in_reply_to: 2, root_id: 2 },	<-- Chirp struct of a reply
 		},
 		"users" : { <-- DBStructure.Users map[int]string
 			"1": { id: 1, email: "blabla@blub.com", password: <hash> },
 			"2": { id: 2, email: "blubblub@bla.com", password: <hash> },
-		}
+		},
+		"follows": { "1": { "2": "2024-01-02T03:04:05Z" } },	<-- DBStructure.Follows, follower -> followed user -> since
+		"likes": { "2": { "1": "2024-01-02T03:04:05Z" } },	<-- DBStructure.Likes, chirp -> user -> since
+		"rechirps": { "2": { "1": "2024-01-02T03:04:05Z" } },	<-- DBStructure.Rechirps, chirp -> user -> since
+		"revisions": { "2": [ { chirp_id: 2, number: 1, body: "blub" } ] },	<-- DBStructure.Revisions, chirp -> replaced bodies
+		"media": { "1": { id: 1, owner_id: 1, chirp_id: 2, key: "<hex>.png" } },	<-- DBStructure.Media, uploads, the bytes are in the blob store
+		"scheduled": { "1": { id: 1, author_id: 1, body: "later", publish_at: "2024-01-02T03:04:05Z" } },	<-- DBStructure.Scheduled, chirps waiting to be published
+		"sequences": { "chirps": 2, "users": 2, "media": 1, "scheduled": 1 },	<-- DBStructure.Sequences, last handed out IDs
+		"last_lsn": 7,	<-- DBStructure.LastLSN, last mutation contained in this snapshot
+		"events": [ { cursor: 7, type: "chirp_deleted", id: 3 } ],	<-- DBStructure.Events, retained change feed
+		"events_horizon": 0	<-- DBStructure.EventsHorizon, newest cursor no longer retained
 	}
 */
 
 // NEW DB FOR IN-MEMORY ON SERVER START
 func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, Options{})
+}
+
+// NEW DB ON SERVER START, tuned by opts
+func NewDBWithOptions(path string, opts Options) (*DB, error) {
+	if opts.WAL {
+		opts.Cache = true
+		opts.FlushInterval = 0
+	}
+
+	keys, err := newKeyring(opts.EncryptionKey, opts.PreviousEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	flock, err := openFileLock(lockPath(path))
+	if err != nil {
+		return nil, err
+	}
+
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:      path,
+		mu:        &sync.RWMutex{},
+		opts:      opts,
+		done:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+		closeOnce: &sync.Once{},
+		events:    newEventHub(),
+		keys:      keys,
+		flock:     flock,
+	}
+
+	// the cache is only coherent while no other process writes,
+	// so cached DBs hold the exclusive lock until Close
+	err = flock.lock(true)
+	if err != nil {
+		flock.close()
+		return nil, err
+	}
+	if !opts.Cache {
+		defer flock.unlock()
+	}
+
+	err = db.ensureDB()
+	if err != nil {
+		return db, err
+	}
+
+	// key rotation: re-encrypt right away instead of on the next write,
+	// so the previous key is only needed until the server has started.
+	// Each file, the rolling backup included, is rewritten once
+	if keys != nil {
+		stale, err := staleFiles(path, keys)
+		if err != nil {
+			return db, err
+		}
+		if stale {
+			err = recryptFiles(path, opts, opts)
+			if err != nil {
+				return db, err
+			}
+		}
 	}
-	err := db.ensureDB()
-	return db, err
+
+	if opts.Cache {
+		err = db.loadCache()
+		if err != nil {
+			return db, err
+		}
+		if opts.WAL {
+			db.mu.Lock()
+			err = db.openWAL()
+			db.mu.Unlock()
+			if err != nil {
+				return db, err
+			}
+		}
+		if opts.FlushInterval > 0 {
+			db.wg.Add(1)
+			go db.persistLoop()
+		}
+	}
+	return db, nil
 }
 
 // Ensures if a JSON-DB is present or not by reading DB.path.
-// If err is nil, a JSON-DB was found, otherwise calls DB.createDB()
+// If the file is missing or does not decrypt and parse, the rolling
+// backup at DB.backupPath() is restored instead. Only when neither exists
+// a fresh JSON-DB is created via DB.createDB().
+// A missing or unknown encryption key fails right away, it would
+// fail the backup the same way.
+// Existing JSON-DBs are brought to the latest schema via DB.migrate()
 func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return db.createDB()
+	data, err := os.ReadFile(db.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
-	return err
+	exists := err == nil
+	if exists {
+		err = db.checkSnapshot(data)
+		if err == nil {
+			return db.migrate()
+		}
+		if errors.Is(err, ErrEncrypted) || errors.Is(err, ErrUnknownKey) {
+			return err
+		}
+	}
+
+	backup, backupErr := os.ReadFile(db.backupPath())
+	if backupErr == nil && db.checkSnapshot(backup) == nil {
+		if exists {
+			// keep the broken file around for inspection instead of overwriting it
+			log.Printf("database %s is corrupt (%s), restoring from %s", db.path, err, db.backupPath())
+			err = os.Rename(db.path, db.path+".corrupt")
+			if err != nil {
+				return err
+			}
+		}
+		err = db.writeFile(backup)
+		if err != nil {
+			return err
+		}
+		return db.migrate()
+	}
+
+	if exists {
+		return ErrCorrupt
+	}
+	return db.createDB()
+}
+
+// decodes a snapshot read from disk the way DB.loadDB() does,
+// telling a healthy file from a corrupt one
+func (db *DB) checkSnapshot(data []byte) error {
+	plain, _, err := db.keys.open(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, &DBStructure{})
 }
 
 // Creates a new JSON-DB by creating the DBStructure struct
 // and handing this struct to the writeDB() method
 func (db *DB) createDB() error {
 	dbStructure := DBStructure{
+		SchemaVersion: latestSchemaVersion(),
 		Chirps:        map[int]Chirp{},
 		Users:         map[int]User{},
 		RefreshTokens: map[string]RefreshToken{},
+		Follows:       map[int]map[int]time.Time{},
+		Likes:         map[int]map[int]time.Time{},
+		Rechirps:      map[int]map[int]time.Time{},
+		Revisions:     map[int][]Revision{},
+		Media:         map[int]Media{},
+		Scheduled:     map[int]ScheduledChirp{},
 	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	return db.writeDB(dbStructure)
 }
 
 func (db *DB) ResetDB() error {
-	err := os.Remove(db.path)
-	if errors.Is(err, os.ErrNotExist) {
+	err := db.flock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer db.flock.unlock()
+
+	for _, path := range []string{db.path, db.backupPath()} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err = db.ensureDB()
+	if err != nil {
+		return err
+	}
+	if db.cache == nil {
 		return nil
 	}
-	return db.ensureDB()
+
+	err = db.loadCache()
+	if err != nil || db.wal == nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compactLocked()
 }
 
-// Writes JSON-DB content to provided DBStructure by
-// handling mutual exclusions, marshalling content to JSON and
-// write a JSON File to Disk by calling os.WriteFile()
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// Ends all event subscriptions, stops the background persister, if any,
+// flushes unpersisted changes of the cache to disk and releases
+// the cross-process lock. Safe to call more than once
+func (db *DB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		db.events.closeAll()
+		close(db.done)
+		db.wg.Wait()
+		err = db.Flush()
+		if db.wal != nil {
+			closeErr := db.wal.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}
+		closeErr := db.flock.close()
+		if err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// Runs fn against a consistent snapshot of the JSON-DB while holding
+// the read lock, and the shared file lock when reading from disk. fn must not modify tx or keep references to it
+// after returning; with Options.Cache tx is the resident cache itself
+func (db *DB) View(fn func(tx *DBStructure) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.cache != nil {
+		return fn(db.cache)
+	}
+
+	err := db.flock.lock(false)
+	if err != nil {
+		return err
+	}
+	defer db.flock.unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	return fn(&dbStructure)
+}
+
+// Runs fn as a read-modify-write transaction on the JSON-DB.
+// The write lock is held across load, fn and write, so concurrent
+// Updates are serialized and never lose each other's changes,
+// the exclusive file lock does the same for other processes.
+// If fn returns an error nothing is written and the error is returned,
+// except for errRollback which only skips the write.
+// Recorded mutations are published to subscribers once persisted.
+// With Options.Cache fn works on the resident cache, which is
+// rolled back if fn fails halfway, see DB.updateCache()
+func (db *DB) Update(fn func(tx *DBStructure) error) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.cache != nil {
+		return db.updateCache(fn)
+	}
+
+	err := db.flock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer db.flock.unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+	if errors.Is(err, errRollback) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := dbStructure.pending
+	dbStructure.pending = nil
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	db.publish(entries)
+	return nil
+}
+
+// Writes JSON-DB content to provided DBStructure by
+// marshalling content to JSON, encrypting it if configured and
+// replacing the JSON File on Disk atomically via DB.writeFile().
+// Callers must hold db.mu for writing
+func (db *DB) writeDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
+	data, err = db.keys.encode(data)
+	if err != nil {
+		return err
+	}
+
+	return db.writeFile(data)
+}
+
+// Crash-safe replacement of the JSON File on Disk:
+// data goes to a temp file which is fsynced, the current file is
+// rotated to DB.backupPath() as last good snapshot and the temp file
+// is renamed into place. A crash at any point leaves either the old
+// or the new snapshot readable, which DB.ensureDB() recovers from
+func (db *DB) writeFile(data []byte) error {
+	tmpPath := db.path + ".tmp"
+	err := writeSynced(tmpPath, data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(db.path, db.backupPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Rename(tmpPath, db.path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(db.path))
+}
 
+// writes data to a new file at path and fsyncs it,
+// removing the file again if that fails
+func writeSynced(path string, data []byte) error {
 	perm := os.FileMode(syscall.S_IRUSR | syscall.S_IWUSR)
-	err = os.WriteFile(db.path, data, perm)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
 
-	return nil
+// path of the rolling backup holding the previous snapshot
+func (db *DB) backupPath() string {
+	return db.path + ".bak"
+}
+
+// fsyncs a directory so renames inside it survive a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
 // Loads a JSON-DB from Disk by
-// handling mutual exclusions, creating an empty DBStructure struct
-// to fill with data from Disk, Unmarshalling JSON data from Disk to
-// to in-memory DBStructure and returning said DBStructure
+// creating an empty DBStructure struct to fill with data from Disk,
+// decrypting it if needed, Unmarshalling JSON data to in-memory DBStructure
+// and returning said DBStructure.
+// Callers must hold db.mu for reading or writing
 func (db *DB) loadDB() (DBStructure, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
 	dbStructure := DBStructure{}
 	data, err := os.ReadFile(db.path)
 	if errors.Is(err, os.ErrNotExist) {
 		return dbStructure, err
 	}
+	data, _, err = db.keys.open(data)
+	if err != nil {
+		return dbStructure, err
+	}
 	err = json.Unmarshal(data, &dbStructure)
 	if err != nil {
 		return dbStructure, err
 	}
+	dbStructure.buildIndexes()
+	dbStructure.clock = db.opts.Clock
 	return dbStructure, nil
 }
+
+// the current time in UTC, as told by Options.Clock
+func (tx *DBStructure) now() time.Time {
+	if tx.clock == nil {
+		return time.Now().UTC()
+	}
+	return tx.clock().UTC()
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	stressWorkers = 8
+	stressWrites  = 25
+)
+
+// Hammers Update from many goroutines at once. Every write has to
+// survive with its own ID, in memory and after reopening the file
+func TestConcurrentUpdatesLoseNoWrites(t *testing.T) {
+	modes := map[string]Options{
+		"disk":  {},
+		"cache": {Cache: true},
+		"wal":   {WAL: true},
+	}
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := NewDBWithOptions(path, opts)
+			if err != nil {
+				t.Fatalf("could not open database: %s", err)
+			}
+
+			author, err := db.CreateUser("author@example.com", "hash")
+			if err != nil {
+				t.Fatalf("could not create author: %s", err)
+			}
+
+			wg := &sync.WaitGroup{}
+			errs := make(chan error, 2*stressWorkers*stressWrites)
+			for worker := range stressWorkers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range stressWrites {
+						_, err := db.CreateChirp(fmt.Sprintf("chirp %d-%d", worker, i), author.ID, nil)
+						if err != nil {
+							errs <- err
+						}
+						_, err = db.CreateUser(fmt.Sprintf("user-%d-%d@example.com", worker, i), "hash")
+						if err != nil {
+							errs <- err
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("concurrent write failed: %s", err)
+			}
+
+			assertAllWrites(t, db, author.ID)
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("could not close database: %s", err)
+			}
+
+			reopened, err := NewDBWithOptions(path, opts)
+			if err != nil {
+				t.Fatalf("could not reopen database: %s", err)
+			}
+			defer reopened.Close()
+			assertAllWrites(t, reopened, author.ID)
+		})
+	}
+}
+
+// checks that db holds exactly the chirps and users written by
+// TestConcurrentUpdatesLoseNoWrites, each with a distinct ID
+func assertAllWrites(t *testing.T, db *DB, authorID int) {
+	t.Helper()
+	total := stressWorkers * stressWrites
+
+	chirps, err := db.GetChirpsByAuthor(authorID)
+	if err != nil {
+		t.Fatalf("could not read chirps: %s", err)
+	}
+	if len(chirps) != total {
+		t.Errorf("got %d chirps, want %d", len(chirps), total)
+	}
+	chirpIDs := map[int]struct{}{}
+	bodies := map[string]struct{}{}
+	for _, chirp := range chirps {
+		chirpIDs[chirp.ID] = struct{}{}
+		bodies[chirp.Body] = struct{}{}
+	}
+	if len(chirpIDs) != len(chirps) || len(bodies) != len(chirps) {
+		t.Errorf("got %d chirp IDs and %d bodies for %d chirps", len(chirpIDs), len(bodies), len(chirps))
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatalf("could not read users: %s", err)
+	}
+	// the author comes on top
+	if len(users) != total+1 {
+		t.Errorf("got %d users, want %d", len(users), total+1)
+	}
+	userIDs := map[int]struct{}{}
+	for _, user := range users {
+		userIDs[user.ID] = struct{}{}
+	}
+	if len(userIDs) != len(users) {
+		t.Errorf("got %d user IDs for %d users", len(userIDs), len(users))
+	}
+}
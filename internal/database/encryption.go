@@ -0,0 +1,254 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrEncrypted = errors.New("database is encrypted but no encryption key is configured")
+var ErrUnknownKey = errors.New("database is encrypted with a key that is not configured")
+
+const encryptionAlgorithm = "aes-256-gcm"
+
+/*
+ENCRYPTED FILE FORMAT:
+The snapshot, its backup and every WAL line are stored as an envelope
+instead of plain JSON. key_id names the key without revealing it,
+so files written with a previous key stay readable during rotation
+
+{ "encrypted": "aes-256-gcm", "key_id": "1a2b3c4d5e6f7a8b", "nonce": <base64>, "data": <base64> }
+*/
+type envelope struct {
+	Encrypted string `json:"encrypted"`
+	KeyID     string `json:"key_id"`
+	Nonce     []byte `json:"nonce"`
+	Data      []byte `json:"data"`
+}
+
+var envelopePrefix = []byte(`{"encrypted":`)
+
+// the current key, used for writing, and all keys accepted for reading
+type keyring struct {
+	currentID string
+	ciphers   map[string]cipher.AEAD
+}
+
+// Builds a keyring from hex encoded 32 byte keys.
+// Returns nil when current is empty, which means plaintext storage
+func newKeyring(current string, previous []string) (*keyring, error) {
+	if current == "" {
+		return nil, nil
+	}
+
+	ring := &keyring{ciphers: map[string]cipher.AEAD{}}
+	for i, hexKey := range append([]string{current}, previous...) {
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("encryption keys must be 32 bytes, hex encoded")
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		if i == 0 {
+			ring.currentID = id
+		}
+		ring.ciphers[id] = aead
+	}
+	return ring, nil
+}
+
+// encrypts plain with the current key into an envelope
+func (ring *keyring) seal(plain []byte) ([]byte, error) {
+	aead := ring.ciphers[ring.currentID]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{
+		Encrypted: encryptionAlgorithm,
+		KeyID:     ring.currentID,
+		Nonce:     nonce,
+		Data:      aead.Seal(nil, nonce, plain, nil),
+	})
+}
+
+// Turns data as read from disk into plain JSON.
+// Plain JSON passes through when ring is nil, or is accepted for
+// migrating to encryption otherwise. stale reports that data was not
+// written with the current key and should be rewritten
+func (ring *keyring) open(data []byte) (plain []byte, stale bool, err error) {
+	// envelopes always start with their marker, checking for it
+	// spares parsing a large plain snapshot twice
+	if !bytes.HasPrefix(data, envelopePrefix) {
+		return data, ring != nil, nil
+	}
+
+	env := envelope{}
+	err = json.Unmarshal(data, &env)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ring == nil {
+		return nil, false, ErrEncrypted
+	}
+	if env.Encrypted != encryptionAlgorithm {
+		return nil, false, fmt.Errorf("unsupported encryption %q", env.Encrypted)
+	}
+	aead, ok := ring.ciphers[env.KeyID]
+	if !ok {
+		return nil, false, ErrUnknownKey
+	}
+
+	plain, err = aead.Open(nil, env.Nonce, env.Data, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decrypt database: %w", err)
+	}
+	return plain, env.KeyID != ring.currentID, nil
+}
+
+// the counterpart of open for writing; plain JSON when ring is nil
+func (ring *keyring) encode(plain []byte) ([]byte, error) {
+	if ring == nil {
+		return plain, nil
+	}
+	return ring.seal(plain)
+}
+
+// Rewrites the snapshot at path, its backup and its WAL, decrypting
+// them with the keys of from and encrypting them with the current key
+// of to. An empty to.EncryptionKey writes plain JSON.
+// Meant for offline use, while no server has the files open;
+// the exclusive file lock makes it fail with ErrLocked otherwise
+func RecryptFiles(path string, from Options, to Options) error {
+	return withFileLock(lockPath(path), true, func() error {
+		return recryptFiles(path, from, to)
+	})
+}
+
+func recryptFiles(path string, from Options, to Options) error {
+	fromRing, err := newKeyring(from.EncryptionKey, from.PreviousEncryptionKeys)
+	if err != nil {
+		return err
+	}
+	toRing, err := newKeyring(to.EncryptionKey, nil)
+	if err != nil {
+		return err
+	}
+
+	// recrypt everything in memory first, so a file that cannot be
+	// decrypted leaves all of them untouched
+	outputs := map[string][]byte{}
+	for _, file := range []string{path, path + ".bak", path + ".wal"} {
+		out, err := recryptFile(file, strings.HasSuffix(file, ".wal"), fromRing, toRing)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		outputs[file] = out
+	}
+
+	for file, out := range outputs {
+		tmpPath := file + ".tmp"
+		err = writeSynced(tmpPath, out)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmpPath, file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether the snapshot at path, its backup or its WAL hold data
+// not written with the current key of ring, which recryptFiles() fixes
+func staleFiles(path string, ring *keyring) (bool, error) {
+	for _, file := range []string{path, path + ".bak", path + ".wal"} {
+		chunks, err := readChunks(file, strings.HasSuffix(file, ".wal"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, chunk := range chunks {
+			_, stale, err := ring.open(chunk)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", file, err)
+			}
+			if stale {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// reads a file as one chunk, or line by line for WAL files
+func readChunks(path string, lines bool) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !lines {
+		return [][]byte{data}, nil
+	}
+
+	chunks := [][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		chunks = append(chunks, append([]byte{}, scanner.Bytes()...))
+	}
+	return chunks, scanner.Err()
+}
+
+// recrypts the contents of one file, line by line for WAL files
+func recryptFile(path string, lines bool, from, to *keyring) ([]byte, error) {
+	chunks, err := readChunks(path, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []byte{}
+	for _, chunk := range chunks {
+		plain, _, err := from.open(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		encoded, err := to.encode(plain)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, encoded...)
+		if lines {
+			out = append(out, '\n')
+		}
+	}
+	return out, nil
+}
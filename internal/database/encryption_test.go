@@ -0,0 +1,112 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// opening with a new key re-encrypts the snapshot and its backup,
+// after which the previous key is no longer needed
+func TestOpenRotatesKey(t *testing.T) {
+	oldKey := strings.Repeat("11", 32)
+	newKey := strings.Repeat("22", 32)
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDBWithOptions(path, Options{EncryptionKey: oldKey})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err)
+	}
+	// two writes, so the rolling backup exists too
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		_, err = db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+	}
+	db.Close()
+
+	newOnly, err := newKeyring(newKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = staleFiles(path, newOnly)
+	if err == nil {
+		t.Fatal("files written with the old key were readable with the new one")
+	}
+
+	db, err = NewDBWithOptions(path, Options{EncryptionKey: newKey, PreviousEncryptionKeys: []string{oldKey}})
+	if err != nil {
+		t.Fatalf("could not reopen database with the new key: %s", err)
+	}
+	db.Close()
+
+	stale, err := staleFiles(path, newOnly)
+	if err != nil || stale {
+		t.Fatalf("files not re-encrypted with the new key: stale %t, %v", stale, err)
+	}
+	db, err = NewDBWithOptions(path, Options{EncryptionKey: newKey})
+	if err != nil {
+		t.Fatalf("could not open database without the old key: %s", err)
+	}
+	defer db.Close()
+	users, err := db.GetUsers()
+	if err != nil || len(users) != 2 {
+		t.Errorf("got %d users and %v after rotation, want 2", len(users), err)
+	}
+}
+
+// a snapshot whose ciphertext is damaged is still valid JSON,
+// opening has to decrypt it to fall back to the backup
+func TestOpenRestoresBackupOfCorruptCiphertext(t *testing.T) {
+	key := strings.Repeat("11", 32)
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDBWithOptions(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("could not open database: %s", err)
+	}
+	// two writes, so the rolling backup holds the first user
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		_, err = db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+	}
+	db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := envelope{}
+	err = json.Unmarshal(data, &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Data[0] ^= 0xff
+	data, err = json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDBWithOptions(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("could not open database with a corrupt snapshot: %s", err)
+	}
+	defer db.Close()
+	_, err = db.GetUserByEmail("a@example.com")
+	if err != nil {
+		t.Errorf("user of the backup is missing: %s", err)
+	}
+	_, err = os.Stat(path + ".corrupt")
+	if err != nil {
+		t.Errorf("corrupt snapshot was not kept: %s", err)
+	}
+}
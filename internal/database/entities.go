@@ -0,0 +1,123 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the kinds of Entity
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+)
+
+// a #hashtag or @mention found in a chirp body. Start and End count
+// Unicode code points into the body, End is exclusive.
+// Hashtags carry their Tag as TagKey() gives it,
+// mentions the UserID of the mentioned email
+type Entity struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Tag    string `json:"tag,omitempty"`
+	UserID int    `json:"user_id,omitempty"`
+}
+
+// hashtags are letters, digits and underscores, mentions name a user by email
+var entityPattern = regexp.MustCompile(`#[\p{L}\p{N}_]+|@[\w.+-]+@[\w-]+(?:\.[\w-]+)+`)
+
+// normalizes a hashtag, with or without its #, for lookups
+func TagKey(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// finds the entities in body, in order. userIDByEmail resolves mentions,
+// those of unknown emails are left out. Entities only start after
+// whitespace or punctuation, so neither "a#b" nor a plain email is one
+func extractEntities(body string, userIDByEmail func(email string) (int, bool)) []Entity {
+	var entities []Entity
+	for _, loc := range entityPattern.FindAllStringIndex(body, -1) {
+		start, end := loc[0], loc[1]
+		if start > 0 {
+			previous, _ := utf8.DecodeLastRuneInString(body[:start])
+			if unicode.IsLetter(previous) || unicode.IsDigit(previous) || strings.ContainsRune("_#@", previous) {
+				continue
+			}
+		}
+
+		text := body[start:end]
+		entity := Entity{
+			Text:  text,
+			Start: utf8.RuneCountInString(body[:start]),
+			End:   utf8.RuneCountInString(body[:end]),
+		}
+		if text[0] == '#' {
+			// #2024 is a number, not a topic
+			if strings.TrimFunc(text[1:], unicode.IsDigit) == "" {
+				continue
+			}
+			entity.Type = EntityHashtag
+			entity.Tag = TagKey(text)
+		} else {
+			userID, ok := userIDByEmail(text[1:])
+			if !ok {
+				continue
+			}
+			entity.Type = EntityMention
+			entity.UserID = userID
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+// resolves mentions against the email index of tx
+func (tx *DBStructure) userIDByEmail(email string) (int, bool) {
+	user, err := tx.userByEmail(email)
+	if err != nil {
+		return 0, false
+	}
+	return user.ID, true
+}
+
+// Reads the visible Chirps using a hashtag via the tag index,
+// tag is matched as TagKey() normalizes it
+func (db *DB) GetChirpsByTag(tag string) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for id := range tx.idx.chirpsByTag[TagKey(tag)] {
+			chirp := tx.Chirps[id]
+			if !chirp.IsDeleted() {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chirps, nil
+}
+
+// Reads the visible Chirps mentioning userID via the mention index
+func (db *DB) GetMentions(userID int) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for id := range tx.idx.mentions[userID] {
+			chirp := tx.Chirps[id]
+			if !chirp.IsDeleted() {
+				chirps = append(chirps, chirp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chirps, nil
+}
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCursorExpired = errors.New("events after cursor are no longer retained")
+var ErrSubscriptionLagged = errors.New("subscriber fell too far behind")
+
+// FromNow subscribes to new events only, skipping the retained backlog
+const FromNow int64 = -1
+
+// number of events kept for subscribers catching up
+const eventRetention = 1000
+
+// maximum events queued for a single subscriber before it is dropped
+const maxSubscriberQueue = 10000
+
+type EventType string
+
+const (
+	EventChirpCreated   EventType = "chirp_created"
+	EventChirpDeleted   EventType = "chirp_deleted"
+	EventChirpRestored  EventType = "chirp_restored"
+	EventChirpPurged    EventType = "chirp_purged"
+	EventChirpEdited    EventType = "chirp_edited"
+	EventUserCreated    EventType = "user_created"
+	EventUserUpdated    EventType = "user_updated"
+	EventUserUpgraded   EventType = "user_upgraded"
+	EventTokenRevoked   EventType = "token_revoked"
+	EventUserFollowed   EventType = "user_followed"
+	EventUserUnfollowed EventType = "user_unfollowed"
+	EventChirpLiked     EventType = "chirp_liked"
+	EventChirpUnliked   EventType = "chirp_unliked"
+	EventRechirped      EventType = "rechirped"
+	EventUnrechirped    EventType = "unrechirped"
+)
+
+// the event types of reacting with kind and taking it back
+var reactionEventTypes = map[ReactionKind][2]EventType{
+	ReactionLike:    {EventChirpLiked, EventChirpUnliked},
+	ReactionRechirp: {EventRechirped, EventUnrechirped},
+}
+
+// one change to the database, as seen by subscribers.
+// EventChirpDeleted means the chirp moved to the trash and is hidden,
+// EventChirpPurged that it is gone for good.
+// Cursor is strictly increasing; pass the last seen Cursor to
+// Store.Subscribe() to resume after a restart.
+// User never carries the hashed password
+type Event struct {
+	Cursor   int64     `json:"cursor"`
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	ID       int       `json:"id,omitempty"`
+	Chirp    *Chirp    `json:"chirp,omitempty"`
+	User     *User     `json:"user,omitempty"`
+	UserID   int       `json:"user_id,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Follow   *Follow   `json:"follow,omitempty"`
+	Reaction *Reaction `json:"reaction,omitempty"`
+}
+
+// strips what subscribers must not see from a user
+func publicUser(user User) *User {
+	user.HashedPassword = ""
+	return &user
+}
+
+// A live feed of events. Read C until it is closed, then check Err()
+// to tell a regular Close() from a dropped subscription
+type Subscription struct {
+	C <-chan Event
+
+	c     chan Event
+	hub   *eventHub
+	mu    *sync.Mutex
+	queue []Event
+	err   error
+	wake  chan struct{}
+	done  chan struct{}
+	once  *sync.Once
+}
+
+// ends the subscription and closes C
+func (s *Subscription) Close() {
+	s.stop(nil)
+}
+
+// why C was closed, nil after Close()
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) stop(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		s.hub.remove(s)
+		close(s.done)
+	})
+}
+
+// queues events for delivery, dropping the subscription
+// if it can not keep up
+func (s *Subscription) push(events []Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, events...)
+	lagged := len(s.queue) > maxSubscriberQueue
+	s.mu.Unlock()
+
+	if lagged {
+		go s.stop(ErrSubscriptionLagged)
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// delivers queued events to C in order until the subscription ends
+func (s *Subscription) pump() {
+	defer close(s.c)
+
+	for {
+		s.mu.Lock()
+		batch := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, event := range batch {
+			select {
+			case s.c <- event:
+			case <-s.done:
+				return
+			}
+		}
+
+		if len(batch) > 0 {
+			continue
+		}
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fans events out to all subscriptions of one database.
+// Callers serialize publish() and subscribe() with their write lock,
+// so no event falls between backlog and live delivery
+type eventHub struct {
+	mu   *sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		mu:   &sync.Mutex{},
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+func (h *eventHub) subscribe(backlog []Event) *Subscription {
+	c := make(chan Event)
+	s := &Subscription{
+		C:     c,
+		c:     c,
+		hub:   h,
+		mu:    &sync.Mutex{},
+		queue: backlog,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		once:  &sync.Once{},
+	}
+
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+
+	go s.pump()
+	return s
+}
+
+func (h *eventHub) remove(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+func (h *eventHub) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		s.push(events)
+	}
+}
+
+// ends every subscription, used on Close
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	subs := make([]*Subscription, 0, len(h.subs))
+	for s := range h.subs {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range subs {
+		s.Close()
+	}
+}
+
+// the event a WAL entry is published as, if any.
+// Saved refresh tokens are live credentials and never published,
+// uploads and scheduled chirps only become visible with the chirp
+// they are attached to or published as
+func (entry walEntry) event() (Event, bool) {
+	event := Event{
+		Cursor: entry.LSN,
+		Time:   entry.Time,
+	}
+
+	switch entry.Op {
+	case opChirpCreated:
+		event.Type = EventChirpCreated
+		event.ID = entry.Chirp.ID
+		event.Chirp = entry.Chirp
+	case opChirpTrashed:
+		event.Type = EventChirpDeleted
+		event.ID = entry.ID
+	case opChirpRestored:
+		event.Type = EventChirpRestored
+		event.ID = entry.Chirp.ID
+		event.Chirp = entry.Chirp
+	case opChirpDeleted:
+		event.Type = EventChirpPurged
+		event.ID = entry.ID
+	case opChirpEdited:
+		event.Type = EventChirpEdited
+		event.ID = entry.Chirp.ID
+		event.Chirp = entry.Chirp
+	case opUserCreated:
+		event.Type = EventUserCreated
+		event.ID = entry.User.ID
+		event.User = publicUser(*entry.User)
+	case opUserUpdated:
+		event.Type = EventUserUpdated
+		event.ID = entry.User.ID
+		event.User = publicUser(*entry.User)
+	case opUserUpgraded:
+		event.Type = EventUserUpgraded
+		event.ID = entry.ID
+	case opTokenRevoked:
+		event.Type = EventTokenRevoked
+		event.UserID = entry.Token.UserID
+		event.Token = entry.Token.Token
+	case opFollowed:
+		event.Type = EventUserFollowed
+		event.Follow = entry.Follow
+	case opUnfollowed:
+		event.Type = EventUserUnfollowed
+		event.Follow = entry.Follow
+	case opReacted:
+		event.Type = reactionEventTypes[entry.Reaction.Kind][0]
+		event.ID = entry.Reaction.ChirpID
+		event.Reaction = entry.Reaction
+	case opUnreacted:
+		event.Type = reactionEventTypes[entry.Reaction.Kind][1]
+		event.ID = entry.Reaction.ChirpID
+		event.Reaction = entry.Reaction
+	default:
+		return Event{}, false
+	}
+	return event, true
+}
+
+// appends the event of entry to the journal of tx,
+// trimming it back to eventRetention once it doubled
+func (tx *DBStructure) journal(entry walEntry) {
+	event, ok := entry.event()
+	if !ok {
+		return
+	}
+
+	tx.Events = append(tx.Events, event)
+	if len(tx.Events) > 2*eventRetention {
+		drop := len(tx.Events) - eventRetention
+		tx.EventsHorizon = tx.Events[drop-1].Cursor
+		tx.Events = append([]Event{}, tx.Events[drop:]...)
+	}
+}
+
+// the retained events of tx after cursor
+func (tx *DBStructure) eventsAfter(after int64) ([]Event, error) {
+	if after == FromNow || after >= tx.LastLSN {
+		return nil, nil
+	}
+	if after < tx.EventsHorizon {
+		return nil, ErrCursorExpired
+	}
+
+	backlog := []Event{}
+	for _, event := range tx.Events {
+		if event.Cursor > after {
+			backlog = append(backlog, event)
+		}
+	}
+	return backlog, nil
+}
+
+// Subscribes to changes after the given cursor. Retained events are
+// delivered first, followed by live ones. Pass FromNow to skip the backlog,
+// 0 to start at the oldest event still retained
+func (db *DB) Subscribe(after int64) (*Subscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := db.cache
+	if tx == nil {
+		err := db.flock.lock(false)
+		if err != nil {
+			return nil, err
+		}
+		defer db.flock.unlock()
+
+		dbStructure, err := db.loadDB()
+		if err != nil {
+			return nil, err
+		}
+		tx = &dbStructure
+	}
+
+	if after == 0 {
+		after = tx.EventsHorizon
+	}
+	backlog, err := tx.eventsAfter(after)
+	if err != nil {
+		return nil, err
+	}
+	return db.events.subscribe(backlog), nil
+}
+
+// publishes the committed entries of one Update.
+// Callers must hold db.mu for writing
+func (db *DB) publish(entries []walEntry) {
+	events := []Event{}
+	for _, entry := range entries {
+		event, ok := entry.event()
+		if ok {
+			events = append(events, event)
+		}
+	}
+	db.events.publish(events)
+}
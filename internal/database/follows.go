@@ -0,0 +1,121 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrSelfFollow = errors.New("users can not follow themselves")
+
+// one edge of the follow graph: FollowerID follows FolloweeID since CreatedAt
+type Follow struct {
+	FollowerID int       `json:"follower_id"`
+	FolloweeID int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Lets followerID follow followeeID inside a DB.Update() transaction.
+// Following twice keeps the original Follow.
+// Returns ErrNotExist if either user does not exist
+func (db *DB) FollowUser(followerID, followeeID int) (Follow, error) {
+	follow := Follow{}
+	err := db.Update(func(tx *DBStructure) error {
+		if followerID == followeeID {
+			return ErrSelfFollow
+		}
+		_, ok := tx.Users[followerID]
+		if !ok {
+			return ErrNotExist
+		}
+		_, ok = tx.Users[followeeID]
+		if !ok {
+			return ErrNotExist
+		}
+
+		createdAt, ok := tx.Follows[followerID][followeeID]
+		if ok {
+			follow = Follow{FollowerID: followerID, FolloweeID: followeeID, CreatedAt: createdAt}
+			return errRollback
+		}
+
+		follow = Follow{FollowerID: followerID, FolloweeID: followeeID, CreatedAt: tx.now()}
+		return tx.apply(walEntry{Op: opFollowed, Follow: &follow})
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+// Removes the Follow of followerID on followeeID, if there is one
+func (db *DB) UnfollowUser(followerID, followeeID int) error {
+	return db.Update(func(tx *DBStructure) error {
+		_, ok := tx.Follows[followerID][followeeID]
+		if !ok {
+			return errRollback
+		}
+		return tx.apply(walEntry{Op: opUnfollowed, Follow: &Follow{FollowerID: followerID, FolloweeID: followeeID}})
+	})
+}
+
+// Reads who follows userID, via the followers index
+func (db *DB) GetFollowers(userID int) ([]Follow, error) {
+	follows := []Follow{}
+	err := db.View(func(tx *DBStructure) error {
+		for followerID := range tx.idx.followers[userID] {
+			follows = append(follows, Follow{
+				FollowerID: followerID,
+				FolloweeID: userID,
+				CreatedAt:  tx.Follows[followerID][userID],
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return follows, nil
+}
+
+// Reads whom userID follows
+func (db *DB) GetFollowing(userID int) ([]Follow, error) {
+	follows := []Follow{}
+	err := db.View(func(tx *DBStructure) error {
+		for followeeID, createdAt := range tx.Follows[userID] {
+			follows = append(follows, Follow{
+				FollowerID: userID,
+				FolloweeID: followeeID,
+				CreatedAt:  createdAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return follows, nil
+}
+
+// Reads the home timeline of userID: the visible Chirps of everybody
+// they follow, collected via the author index
+func (db *DB) GetTimeline(userID int) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for authorID := range tx.Follows[userID] {
+			for _, chirp := range tx.chirpsByAuthor(authorID) {
+				if !chirp.IsDeleted() {
+					chirps = append(chirps, chirp)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chirps, nil
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"strings"
+)
+
+// secondary indexes over a DBStructure. They are derived data,
+// never persisted, built on load and kept current by replay()
+type indexes struct {
+	// lowercased email -> user ID
+	userByEmail map[string]int
+	// author ID -> IDs of their chirps
+	chirpsByAuthor map[int]map[int]struct{}
+	// chirp ID -> IDs of the chirps replying to it
+	replies map[int]map[int]struct{}
+	// root chirp ID -> IDs of all replies in its thread
+	threads map[int]map[int]struct{}
+	// TagKey() of a hashtag -> IDs of the chirps using it
+	chirpsByTag map[string]map[int]struct{}
+	// user ID -> IDs of the chirps mentioning them
+	mentions map[int]map[int]struct{}
+	// user ID -> their refresh tokens
+	tokensByUser map[int]map[string]struct{}
+	// user ID -> IDs of the users following them,
+	// the reverse of DBStructure.Follows
+	followers map[int]map[int]struct{}
+	// blob key -> ID of the upload stored under it
+	mediaByKey map[string]int
+	// upload ID -> ID of the scheduled chirp reserving it
+	scheduledMedia map[int]int
+}
+
+// emails match case-insensitively
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// (re)builds all indexes from the maps of tx.
+// On duplicate emails differing only in case the lowest user ID wins
+func (tx *DBStructure) buildIndexes() {
+	tx.idx = &indexes{
+		userByEmail:    map[string]int{},
+		chirpsByAuthor: map[int]map[int]struct{}{},
+		replies:        map[int]map[int]struct{}{},
+		threads:        map[int]map[int]struct{}{},
+		chirpsByTag:    map[string]map[int]struct{}{},
+		mentions:       map[int]map[int]struct{}{},
+		tokensByUser:   map[int]map[string]struct{}{},
+		followers:      map[int]map[int]struct{}{},
+		mediaByKey:     map[string]int{},
+		scheduledMedia: map[int]int{},
+	}
+
+	for id, user := range tx.Users {
+		existing, ok := tx.idx.userByEmail[emailKey(user.Email)]
+		if !ok || id < existing {
+			tx.idx.userByEmail[emailKey(user.Email)] = id
+		}
+	}
+	for _, chirp := range tx.Chirps {
+		tx.idx.addChirp(chirp)
+	}
+	for _, refreshToken := range tx.RefreshTokens {
+		tx.idx.addToken(refreshToken)
+	}
+	for followerID, followees := range tx.Follows {
+		for followeeID := range followees {
+			tx.idx.addFollow(Follow{FollowerID: followerID, FolloweeID: followeeID})
+		}
+	}
+	for id, media := range tx.Media {
+		tx.idx.mediaByKey[media.Key] = id
+	}
+	for _, scheduled := range tx.Scheduled {
+		tx.idx.addScheduled(scheduled)
+	}
+}
+
+func (idx *indexes) addChirp(chirp Chirp) {
+	addID(idx.chirpsByAuthor, chirp.AuthorID, chirp.ID)
+	if chirp.InReplyTo != 0 {
+		addID(idx.replies, chirp.InReplyTo, chirp.ID)
+		addID(idx.threads, chirp.RootID, chirp.ID)
+	}
+	for _, entity := range chirp.Entities {
+		switch entity.Type {
+		case EntityHashtag:
+			addID(idx.chirpsByTag, entity.Tag, chirp.ID)
+		case EntityMention:
+			addID(idx.mentions, entity.UserID, chirp.ID)
+		}
+	}
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	removeID(idx.chirpsByAuthor, chirp.AuthorID, chirp.ID)
+	if chirp.InReplyTo != 0 {
+		removeID(idx.replies, chirp.InReplyTo, chirp.ID)
+		removeID(idx.threads, chirp.RootID, chirp.ID)
+	}
+	for _, entity := range chirp.Entities {
+		switch entity.Type {
+		case EntityHashtag:
+			removeID(idx.chirpsByTag, entity.Tag, chirp.ID)
+		case EntityMention:
+			removeID(idx.mentions, entity.UserID, chirp.ID)
+		}
+	}
+}
+
+// adds id to the set of key, creating the set if needed
+func addID[K comparable](sets map[K]map[int]struct{}, key K, id int) {
+	ids, ok := sets[key]
+	if !ok {
+		ids = map[int]struct{}{}
+		sets[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+// removes id from the set of key, dropping the set once it is empty
+func removeID[K comparable](sets map[K]map[int]struct{}, key K, id int) {
+	ids := sets[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(sets, key)
+	}
+}
+
+// points the email index at user, dropping the entry of a previous email
+func (idx *indexes) putUser(previous, user User) {
+	if previous.ID != 0 && emailKey(previous.Email) != emailKey(user.Email) {
+		delete(idx.userByEmail, emailKey(previous.Email))
+	}
+	idx.userByEmail[emailKey(user.Email)] = user.ID
+}
+
+func (idx *indexes) addToken(refreshToken RefreshToken) {
+	tokens, ok := idx.tokensByUser[refreshToken.UserID]
+	if !ok {
+		tokens = map[string]struct{}{}
+		idx.tokensByUser[refreshToken.UserID] = tokens
+	}
+	tokens[refreshToken.Token] = struct{}{}
+}
+
+func (idx *indexes) removeToken(refreshToken RefreshToken) {
+	tokens := idx.tokensByUser[refreshToken.UserID]
+	delete(tokens, refreshToken.Token)
+	if len(tokens) == 0 {
+		delete(idx.tokensByUser, refreshToken.UserID)
+	}
+}
+
+func (idx *indexes) addScheduled(scheduled ScheduledChirp) {
+	for _, mediaID := range scheduled.MediaIDs {
+		idx.scheduledMedia[mediaID] = scheduled.ID
+	}
+}
+
+func (idx *indexes) removeScheduled(scheduled ScheduledChirp) {
+	for _, mediaID := range scheduled.MediaIDs {
+		delete(idx.scheduledMedia, mediaID)
+	}
+}
+
+func (idx *indexes) addFollow(follow Follow) {
+	addID(idx.followers, follow.FolloweeID, follow.FollowerID)
+}
+
+func (idx *indexes) removeFollow(follow Follow) {
+	removeID(idx.followers, follow.FolloweeID, follow.FollowerID)
+}
+
+// looks up a user by email, ignoring case
+func (tx *DBStructure) userByEmail(email string) (User, error) {
+	id, ok := tx.idx.userByEmail[emailKey(email)]
+	if !ok {
+		return User{}, ErrNotExist
+	}
+	return tx.Users[id], nil
+}
+
+// all chirps of one author, in no particular order
+func (tx *DBStructure) chirpsByAuthor(authorID int) []Chirp {
+	ids := tx.idx.chirpsByAuthor[authorID]
+	chirps := make([]Chirp, 0, len(ids))
+	for id := range ids {
+		chirps = append(chirps, tx.Chirps[id])
+	}
+	return chirps
+}
+
+// all refresh tokens of one user, expired ones included
+func (tx *DBStructure) refreshTokensOf(userID int) []RefreshToken {
+	tokens := tx.idx.tokensByUser[userID]
+	refreshTokens := make([]RefreshToken, 0, len(tokens))
+	for token := range tokens {
+		refreshTokens = append(refreshTokens, tx.RefreshTokens[token])
+	}
+	return refreshTokens
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+const (
+	// how long to wait for another process to release the lock,
+	// in line with the busy timeout of the SQLite backend
+	lockTimeout       = 5 * time.Second
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+/*
+	CROSS-PROCESS LOCKING:
+	DB.mu only serializes goroutines of one process. Every process using
+	the JSON-DB at path additionally takes an advisory lock on path.lock:
+	shared while reading, exclusive while writing. A DB with Options.Cache
+	serves data from memory that other processes could not see changes to,
+	so it holds the exclusive lock from NewDB until Close, a single-writer
+	lease that makes a second instance fail to start with ErrLocked
+*/
+
+// advisory lock on a file, reentrant within the process.
+// The OS lock belongs to the open file, not to a goroutine,
+// so nested lock calls only count and the outermost one locks
+type fileLock struct {
+	file  *os.File
+	mu    *sync.Mutex
+	depth int
+}
+
+func openFileLock(path string) (*fileLock, error) {
+	perm := os.FileMode(syscall.S_IRUSR | syscall.S_IWUSR)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{file: file, mu: &sync.Mutex{}}, nil
+}
+
+// Takes the lock, shared or exclusive, waiting up to lockTimeout
+// for other processes before giving up with ErrLocked.
+// Callers within the process must not ask for exclusive
+// while they already hold it shared, DB.mu takes care of that
+func (l *fileLock) lock(exclusive bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.depth > 0 {
+		l.depth++
+		return nil
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		ok, err := tryFlock(l.file, exclusive)
+		if err != nil {
+			return err
+		}
+		if ok {
+			l.depth = 1
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func (l *fileLock) unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.depth--
+	if l.depth > 0 {
+		return nil
+	}
+	return funlock(l.file)
+}
+
+// closing the file drops any lock still held
+func (l *fileLock) close() error {
+	return l.file.Close()
+}
+
+// path of the lock file next to the JSON-DB at path
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// runs fn while holding the lock file at path,
+// for tools working on the JSON-DB files without a DB
+func withFileLock(path string, exclusive bool, fn func() error) error {
+	l, err := openFileLock(path)
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	err = l.lock(exclusive)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	return fn()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// no flock on this platform, only DB.mu protects the JSON-DB
+func tryFlock(file *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrMediaUnavailable = errors.New("media does not exist, belongs to another user or is already attached")
+var ErrMediaKeyTaken = errors.New("media key is already in use")
+
+// an uploaded file. The database only keeps track of it,
+// the bytes live in a blob store under Key.
+// ChirpID is 0 until the upload is attached to a chirp,
+// which keeps a copy in Chirp.Media
+type Media struct {
+	ID          int       `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	ChirpID     int       `json:"chirp_id,omitempty"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Records an upload of ownerID inside a DB.Update() transaction,
+// after its bytes were stored under key.
+// Returns ErrNotExist if the owner does not exist
+func (db *DB) CreateMedia(ownerID int, key, contentType string, size int64) (Media, error) {
+	media := Media{}
+	err := db.Update(func(tx *DBStructure) error {
+		_, ok := tx.Users[ownerID]
+		if !ok {
+			return ErrNotExist
+		}
+		_, ok = tx.idx.mediaByKey[key]
+		if ok {
+			return ErrMediaKeyTaken
+		}
+
+		media = Media{
+			ID:          tx.nextMediaID(),
+			OwnerID:     ownerID,
+			Key:         key,
+			ContentType: contentType,
+			Size:        size,
+			CreatedAt:   tx.now(),
+		}
+		return tx.apply(walEntry{Op: opMediaCreated, Media: &media})
+	})
+	if err != nil {
+		return Media{}, err
+	}
+
+	return media, nil
+}
+
+// Reads one upload by the key of its bytes, via the key index
+func (db *DB) GetMediaByKey(key string) (Media, error) {
+	media := Media{}
+	err := db.View(func(tx *DBStructure) error {
+		id, ok := tx.idx.mediaByKey[key]
+		if !ok {
+			return ErrNotExist
+		}
+		media = tx.Media[id]
+		return nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+
+	return media, nil
+}
+
+// Removes every upload created before the given time that was never
+// attached to a chirp nor reserved by a scheduled one, returning them
+// so their bytes can be deleted too.
+// Uploads of purged chirps are removed with the chirp
+func (db *DB) PurgeOrphanedMedia(before time.Time) ([]Media, error) {
+	purged := []Media{}
+	err := db.Update(func(tx *DBStructure) error {
+		for _, media := range tx.Media {
+			_, reserved := tx.idx.scheduledMedia[media.ID]
+			if media.ChirpID == 0 && !reserved && media.CreatedAt.Before(before) {
+				purged = append(purged, media)
+			}
+		}
+		if len(purged) == 0 {
+			return errRollback
+		}
+
+		for _, media := range purged {
+			err := tx.apply(walEntry{Op: opMediaDeleted, ID: media.ID})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// Looks up the uploads mediaIDs of authorID for a new chirp, in order.
+// Returns ErrMediaUnavailable if one does not exist, belongs to someone
+// else, is already attached, reserved by a scheduled chirp other than
+// scheduledID or listed twice
+func (tx *DBStructure) attachableMedia(mediaIDs []int, authorID int, scheduledID int) ([]Media, error) {
+	var attached []Media
+	seen := map[int]struct{}{}
+	for _, id := range mediaIDs {
+		media, ok := tx.Media[id]
+		if !ok || media.OwnerID != authorID || media.ChirpID != 0 {
+			return nil, ErrMediaUnavailable
+		}
+		reservedBy, ok := tx.idx.scheduledMedia[id]
+		if ok && reservedBy != scheduledID {
+			return nil, ErrMediaUnavailable
+		}
+		_, ok = seen[id]
+		if ok {
+			return nil, ErrMediaUnavailable
+		}
+		seen[id] = struct{}{}
+		attached = append(attached, media)
+	}
+	return attached, nil
+}
@@ -0,0 +1,440 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this build of chirpy supports")
+
+// describes one step of a schema upgrade
+type Migration struct {
+	Version int
+	Name    string
+}
+
+// a JSON-DB migration, moving DBStructure from Version-1 to Version
+type jsonMigration struct {
+	Migration
+	up func(tx *DBStructure) error
+}
+
+// ordered registry of JSON-DB migrations.
+// Append new ones at the end, never reorder or remove entries:
+// DBStructure.SchemaVersion of a file is an index into this list
+var jsonMigrations = []jsonMigration{
+	{Migration{1, "initialize missing maps"}, func(tx *DBStructure) error {
+		// files written before refresh tokens existed load with nil maps
+		if tx.Chirps == nil {
+			tx.Chirps = map[int]Chirp{}
+		}
+		if tx.Users == nil {
+			tx.Users = map[int]User{}
+		}
+		if tx.RefreshTokens == nil {
+			tx.RefreshTokens = map[string]RefreshToken{}
+		}
+		return nil
+	}},
+	{Migration{2, "initialize id sequences from highest ids"}, func(tx *DBStructure) error {
+		tx.initSequences()
+		return nil
+	}},
+	{Migration{3, "backfill created_at and updated_at"}, func(tx *DBStructure) error {
+		// the real creation times are unknown, the migration time
+		// at least keeps them out of the zero value
+		now := tx.now()
+		for id, chirp := range tx.Chirps {
+			if chirp.CreatedAt.IsZero() {
+				chirp.CreatedAt = now
+				chirp.UpdatedAt = now
+				tx.Chirps[id] = chirp
+			}
+		}
+		for id, user := range tx.Users {
+			if user.CreatedAt.IsZero() {
+				user.CreatedAt = now
+				user.UpdatedAt = now
+				tx.Users[id] = user
+			}
+		}
+		return nil
+	}},
+	{Migration{4, "initialize follows"}, func(tx *DBStructure) error {
+		if tx.Follows == nil {
+			tx.Follows = map[int]map[int]time.Time{}
+		}
+		return nil
+	}},
+	{Migration{5, "initialize likes and rechirps"}, func(tx *DBStructure) error {
+		if tx.Likes == nil {
+			tx.Likes = map[int]map[int]time.Time{}
+		}
+		if tx.Rechirps == nil {
+			tx.Rechirps = map[int]map[int]time.Time{}
+		}
+		return nil
+	}},
+	{Migration{6, "initialize revisions"}, func(tx *DBStructure) error {
+		if tx.Revisions == nil {
+			tx.Revisions = map[int][]Revision{}
+		}
+		return nil
+	}},
+	{Migration{7, "initialize media"}, func(tx *DBStructure) error {
+		if tx.Media == nil {
+			tx.Media = map[int]Media{}
+		}
+		return nil
+	}},
+	{Migration{8, "initialize scheduled chirps"}, func(tx *DBStructure) error {
+		if tx.Scheduled == nil {
+			tx.Scheduled = map[int]ScheduledChirp{}
+		}
+		return nil
+	}},
+	// the SQLite backend enforces this since its migration 2,
+	// files written before still may hold such emails
+	{Migration{9, "check emails are unique ignoring case"}, func(tx *DBStructure) error {
+		users := make([]User, 0, len(tx.Users))
+		for _, user := range tx.Users {
+			users = append(users, user)
+		}
+		return checkUniqueEmails(users)
+	}},
+}
+
+func latestSchemaVersion() int {
+	return jsonMigrations[len(jsonMigrations)-1].Version
+}
+
+// returns the migrations newer than version, in order
+func pendingJSONMigrations(version int) []jsonMigration {
+	pending := []jsonMigration{}
+	for _, m := range jsonMigrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// Brings an existing JSON-DB up to the latest schema in one DB.Update().
+// Only writes when something actually had to be migrated
+func (db *DB) migrate() error {
+	return db.Update(func(tx *DBStructure) error {
+		if tx.SchemaVersion > latestSchemaVersion() {
+			return ErrSchemaTooNew
+		}
+
+		pending := pendingJSONMigrations(tx.SchemaVersion)
+		if len(pending) == 0 {
+			return errRollback
+		}
+
+		for _, m := range pending {
+			err := m.up(tx)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			tx.SchemaVersion = m.Version
+			log.Printf("applied migration %d (%s) to %s", m.Version, m.Name, db.path)
+		}
+		return nil
+	})
+}
+
+// Reports the migrations NewDB would apply to the JSON-DB at path,
+// without changing it. opts only matter for encrypted files.
+// A missing file is created at the latest schema,
+// so nothing is pending for it
+func PendingMigrations(path string, opts Options) ([]Migration, error) {
+	data := []byte{}
+	err := withFileLock(lockPath(path), false, func() error {
+		var err error
+		data, err = os.ReadFile(path)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := newKeyring(opts.EncryptionKey, opts.PreviousEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err = keys.open(data)
+	if err != nil {
+		return nil, err
+	}
+
+	header := struct {
+		SchemaVersion int `json:"schema_version"`
+	}{}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion > latestSchemaVersion() {
+		return nil, ErrSchemaTooNew
+	}
+
+	pending := []Migration{}
+	for _, m := range pendingJSONMigrations(header.SchemaVersion) {
+		pending = append(pending, m.Migration)
+	}
+	return pending, nil
+}
+
+// a SQLite migration, moving PRAGMA user_version from Version-1 to Version.
+// check, if set, runs first and stops the migration with a clear error
+// where up would fail on existing data
+type sqliteMigration struct {
+	Migration
+	up    string
+	check func(tx *sql.Tx) error
+}
+
+// ordered registry of SQLite migrations, same rules as jsonMigrations
+var sqliteMigrations = []sqliteMigration{
+	{Migration{1, "create users, chirps and refresh_tokens"}, sqliteSchema, nil},
+	{Migration{2, "index email without case, chirp authors and token users"}, `
+		CREATE UNIQUE INDEX users_email_nocase ON users (email COLLATE NOCASE);
+		CREATE INDEX chirps_author_id ON chirps (author_id);
+		CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id);
+	`, sqliteCheckUniqueEmails},
+	{Migration{3, "create events journal"}, `
+		CREATE TABLE events (
+			cursor  INTEGER PRIMARY KEY AUTOINCREMENT,
+			payload TEXT    NOT NULL
+		);
+	`, nil},
+	{Migration{4, "add deleted_at to chirps for the trash"}, `
+		ALTER TABLE chirps ADD COLUMN deleted_at DATETIME;
+		CREATE INDEX chirps_deleted_at ON chirps (deleted_at) WHERE deleted_at IS NOT NULL;
+	`, nil},
+	// timestamps are stored in the format go-sqlite3 writes time.Time in,
+	// so they compare correctly as text
+	{Migration{5, "add created_at and updated_at to chirps and users"}, `
+		ALTER TABLE chirps ADD COLUMN created_at DATETIME;
+		ALTER TABLE chirps ADD COLUMN updated_at DATETIME;
+		ALTER TABLE users ADD COLUMN created_at DATETIME;
+		ALTER TABLE users ADD COLUMN updated_at DATETIME;
+		UPDATE chirps SET
+			created_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'),
+			updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
+		UPDATE users SET
+			created_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'),
+			updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
+		CREATE INDEX chirps_created_at ON chirps (created_at);
+	`, nil},
+	{Migration{6, "create follows"}, `
+		CREATE TABLE follows (
+			follower_id INTEGER  NOT NULL,
+			followee_id INTEGER  NOT NULL,
+			created_at  DATETIME NOT NULL,
+			PRIMARY KEY (follower_id, followee_id)
+		);
+		CREATE INDEX follows_followee_id ON follows (followee_id);
+	`, nil},
+	{Migration{7, "add in_reply_to and root_id to chirps for threads"}, `
+		ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER;
+		ALTER TABLE chirps ADD COLUMN root_id INTEGER;
+		CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to) WHERE in_reply_to IS NOT NULL;
+		CREATE INDEX chirps_root_id ON chirps (root_id) WHERE root_id IS NOT NULL;
+	`, nil},
+	// the primary keys keep one reaction per user and chirp
+	// and serve the counts per chirp
+	{Migration{8, "create likes and rechirps"}, `
+		CREATE TABLE likes (
+			chirp_id   INTEGER  NOT NULL,
+			user_id    INTEGER  NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (chirp_id, user_id)
+		);
+		CREATE TABLE rechirps (
+			chirp_id   INTEGER  NOT NULL,
+			user_id    INTEGER  NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (chirp_id, user_id)
+		);
+	`, nil},
+	{Migration{9, "add edited_at to chirps and create chirp_revisions"}, `
+		ALTER TABLE chirps ADD COLUMN edited_at DATETIME;
+		CREATE TABLE chirp_revisions (
+			chirp_id   INTEGER  NOT NULL,
+			number     INTEGER  NOT NULL,
+			body       TEXT     NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (chirp_id, number)
+		);
+	`, nil},
+	// entities holds the JSON of Chirp.Entities,
+	// chirp_tags and chirp_mentions serve the lookups
+	{Migration{10, "add entities to chirps and create chirp_tags and chirp_mentions"}, `
+		ALTER TABLE chirps ADD COLUMN entities TEXT;
+		CREATE TABLE chirp_tags (
+			tag      TEXT    NOT NULL,
+			chirp_id INTEGER NOT NULL,
+			PRIMARY KEY (tag, chirp_id)
+		);
+		CREATE INDEX chirp_tags_chirp_id ON chirp_tags (chirp_id);
+		CREATE TABLE chirp_mentions (
+			user_id  INTEGER NOT NULL,
+			chirp_id INTEGER NOT NULL,
+			PRIMARY KEY (user_id, chirp_id)
+		);
+		CREATE INDEX chirp_mentions_chirp_id ON chirp_mentions (chirp_id);
+	`, nil},
+	// chirps.media holds the JSON of Chirp.Media, the media table
+	// every upload, with chirp_id NULL until it is attached
+	{Migration{11, "add media to chirps and create media"}, `
+		ALTER TABLE chirps ADD COLUMN media TEXT;
+		CREATE TABLE media (
+			id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+			owner_id     INTEGER  NOT NULL,
+			chirp_id     INTEGER,
+			key          TEXT     NOT NULL UNIQUE,
+			content_type TEXT     NOT NULL,
+			size         INTEGER  NOT NULL,
+			created_at   DATETIME NOT NULL
+		);
+		CREATE INDEX media_chirp_id ON media (chirp_id);
+		CREATE INDEX media_orphans ON media (created_at) WHERE chirp_id IS NULL;
+	`, nil},
+	// media_ids holds the JSON of ScheduledChirp.MediaIDs,
+	// scheduled_media reserves each upload for one scheduled chirp
+	{Migration{12, "create scheduled_chirps and scheduled_media"}, `
+		CREATE TABLE scheduled_chirps (
+			id          INTEGER  PRIMARY KEY AUTOINCREMENT,
+			author_id   INTEGER  NOT NULL,
+			body        TEXT     NOT NULL,
+			in_reply_to INTEGER,
+			media_ids   TEXT,
+			publish_at  DATETIME NOT NULL,
+			error       TEXT,
+			created_at  DATETIME NOT NULL,
+			updated_at  DATETIME NOT NULL
+		);
+		CREATE INDEX scheduled_chirps_author_id ON scheduled_chirps (author_id);
+		CREATE INDEX scheduled_chirps_pending ON scheduled_chirps (publish_at) WHERE error IS NULL;
+		CREATE TABLE scheduled_media (
+			media_id     INTEGER PRIMARY KEY,
+			scheduled_id INTEGER NOT NULL
+		);
+		CREATE INDEX scheduled_media_scheduled_id ON scheduled_media (scheduled_id);
+	`, nil},
+}
+
+// Brings the SQLite database up to the latest schema,
+// every migration in its own transaction
+func (db *SQLiteDB) migrate() error {
+	version, err := sqliteUserVersion(db.conn)
+	if err != nil {
+		return err
+	}
+	if version > sqliteMigrations[len(sqliteMigrations)-1].Version {
+		return ErrSchemaTooNew
+	}
+
+	for _, m := range sqliteMigrations {
+		if m.Version <= version {
+			continue
+		}
+
+		err = db.withTx(func(tx *sql.Tx) error {
+			if m.check != nil {
+				err := m.check(tx)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(m.up)
+			if err != nil {
+				return err
+			}
+			// PRAGMA does not take bind parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("applied migration %d (%s) to %s", m.Version, m.Name, db.path)
+	}
+	return nil
+}
+
+// the unique index of migration 2 would fail on emails differing only
+// in case with a bare constraint error, name them instead.
+// Only id and email exist at that schema version
+func sqliteCheckUniqueEmails(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, email FROM users`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.ID, &user.Email)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	return checkUniqueEmails(users)
+}
+
+func sqliteUserVersion(conn *sql.DB) (int, error) {
+	version := 0
+	err := conn.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Reports the migrations NewSQLiteDB would apply to the SQLite database
+// at path, without changing it. opts are ignored, they only exist
+// to match PendingMigrations
+func PendingSQLiteMigrations(path string, opts Options) ([]Migration, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	version, err := sqliteUserVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if version > sqliteMigrations[len(sqliteMigrations)-1].Version {
+		return nil, ErrSchemaTooNew
+	}
+
+	pending := []Migration{}
+	for _, m := range sqliteMigrations {
+		if m.Version > version {
+			pending = append(pending, m.Migration)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrChirpDeleted = errors.New("chirp is deleted")
+var ErrUnknownReaction = errors.New("unknown reaction kind")
+
+// the ways a user can react to a chirp, each at most once per chirp
+type ReactionKind string
+
+const (
+	ReactionLike    ReactionKind = "like"
+	ReactionRechirp ReactionKind = "rechirp"
+)
+
+// UserID reacted with Kind to ChirpID at CreatedAt
+type Reaction struct {
+	Kind      ReactionKind `json:"kind"`
+	ChirpID   int          `json:"chirp_id"`
+	UserID    int          `json:"user_id"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// the reactions to one chirp. The ByMe flags tell whether
+// the user asked about is among them
+type ReactionCounts struct {
+	Likes         int
+	Rechirps      int
+	LikedByMe     bool
+	RechirpedByMe bool
+}
+
+// the map of DBStructure holding reactions of kind, nil for unknown kinds
+func (tx *DBStructure) reactions(kind ReactionKind) map[int]map[int]time.Time {
+	switch kind {
+	case ReactionLike:
+		return tx.Likes
+	case ReactionRechirp:
+		return tx.Rechirps
+	default:
+		return nil
+	}
+}
+
+// Lets userID react with kind to a chirp inside a DB.Update() transaction.
+// Reacting twice keeps the original Reaction.
+// Returns ErrNotExist if the chirp or user does not exist
+// and ErrChirpDeleted if the chirp is in the trash
+func (db *DB) React(kind ReactionKind, chirpID, userID int) error {
+	return db.Update(func(tx *DBStructure) error {
+		reactions := tx.reactions(kind)
+		if reactions == nil {
+			return ErrUnknownReaction
+		}
+		chirp, ok := tx.Chirps[chirpID]
+		if !ok {
+			return ErrNotExist
+		}
+		if chirp.IsDeleted() {
+			return ErrChirpDeleted
+		}
+		_, ok = tx.Users[userID]
+		if !ok {
+			return ErrNotExist
+		}
+
+		_, ok = reactions[chirpID][userID]
+		if ok {
+			return errRollback
+		}
+		return tx.apply(walEntry{Op: opReacted, Reaction: &Reaction{
+			Kind:      kind,
+			ChirpID:   chirpID,
+			UserID:    userID,
+			CreatedAt: tx.now(),
+		}})
+	})
+}
+
+// Takes back the reaction of kind of userID to a chirp, if there is one.
+// Returns ErrNotExist if the chirp does not exist
+// and ErrChirpDeleted if the chirp is in the trash
+func (db *DB) Unreact(kind ReactionKind, chirpID, userID int) error {
+	return db.Update(func(tx *DBStructure) error {
+		reactions := tx.reactions(kind)
+		if reactions == nil {
+			return ErrUnknownReaction
+		}
+		chirp, ok := tx.Chirps[chirpID]
+		if !ok {
+			return ErrNotExist
+		}
+		if chirp.IsDeleted() {
+			return ErrChirpDeleted
+		}
+
+		_, ok = reactions[chirpID][userID]
+		if !ok {
+			return errRollback
+		}
+		return tx.apply(walEntry{Op: opUnreacted, Reaction: &Reaction{
+			Kind:    kind,
+			ChirpID: chirpID,
+			UserID:  userID,
+		}})
+	})
+}
+
+// Counts the reactions to each of ids, looking userID up in them.
+// userID 0 leaves the ByMe flags unset. Chirps without reactions are left out
+func (db *DB) GetReactionCounts(ids []int, userID int) (map[int]ReactionCounts, error) {
+	counts := map[int]ReactionCounts{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, id := range ids {
+			likes := tx.Likes[id]
+			rechirps := tx.Rechirps[id]
+			if len(likes) == 0 && len(rechirps) == 0 {
+				continue
+			}
+
+			_, likedByMe := likes[userID]
+			_, rechirpedByMe := rechirps[userID]
+			counts[id] = ReactionCounts{
+				Likes:         len(likes),
+				Rechirps:      len(rechirps),
+				LikedByMe:     likedByMe,
+				RechirpedByMe: rechirpedByMe,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
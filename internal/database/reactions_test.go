@@ -0,0 +1,45 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+// the trash is closed for reactions in both directions
+func TestReactionsToTrashedChirp(t *testing.T) {
+	for name, db := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@example.com", "hash")
+			if err != nil {
+				t.Fatalf("could not create user: %s", err)
+			}
+			chirp, err := db.CreateChirp("soon trashed", user.ID, nil)
+			if err != nil {
+				t.Fatalf("could not create chirp: %s", err)
+			}
+			err = db.React(ReactionLike, chirp.ID, user.ID)
+			if err != nil {
+				t.Fatalf("could not like chirp: %s", err)
+			}
+			err = db.DeleteChirp(chirp.ID)
+			if err != nil {
+				t.Fatalf("could not trash chirp: %s", err)
+			}
+
+			for _, kind := range []ReactionKind{ReactionLike, ReactionRechirp} {
+				err = db.React(kind, chirp.ID, user.ID)
+				if !errors.Is(err, ErrChirpDeleted) {
+					t.Errorf("React(%s) got %v, want ErrChirpDeleted", kind, err)
+				}
+				err = db.Unreact(kind, chirp.ID, user.ID)
+				if !errors.Is(err, ErrChirpDeleted) {
+					t.Errorf("Unreact(%s) got %v, want ErrChirpDeleted", kind, err)
+				}
+			}
+			err = db.Unreact(ReactionLike, chirp.ID+1, user.ID)
+			if !errors.Is(err, ErrNotExist) {
+				t.Errorf("Unreact of a missing chirp got %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
@@ -11,58 +11,81 @@ type RefreshToken struct {
 }
 
 func (db *DB) SaveRefreshToken(userID int, token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	refreshToken := RefreshToken{
-		UserID:    userID,
-		Token:     token,
-		ExpiresAt: time.Now().Add(time.Hour),
-	}
-	dbStructure.RefreshTokens[token] = refreshToken
-
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.Update(func(tx *DBStructure) error {
+		return tx.apply(walEntry{Op: opTokenSaved, Token: &RefreshToken{
+			UserID:    userID,
+			Token:     token,
+			ExpiresAt: tx.now().Add(time.Hour),
+		}})
+	})
 }
 
 func (db *DB) RevokeRefreshToken(token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	delete(dbStructure.RefreshTokens, token)
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.Update(func(tx *DBStructure) error {
+		refreshToken, ok := tx.RefreshTokens[token]
+		if !ok {
+			return errRollback
+		}
+		return tx.apply(walEntry{Op: opTokenRevoked, Token: &refreshToken})
+	})
 }
 
+// Looks up the token and its User in the same DB.View() transaction,
+// so a concurrent revoke can not hand out a User for a dead token
 func (db *DB) UserForRefreshToken(token string) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(tx *DBStructure) error {
+		refreshToken, ok := tx.RefreshTokens[token]
+		if !ok {
+			return ErrNotExist
+		}
+
+		if refreshToken.ExpiresAt.Before(tx.now()) {
+			return ErrNotExist
+		}
+
+		dbUser, ok := tx.Users[refreshToken.UserID]
+		if !ok {
+			return ErrNotExist
+		}
+		user = dbUser
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	refreshToken, ok := dbStructure.RefreshTokens[token]
-	if !ok {
-		return User{}, ErrNotExist
-	}
+	return user, nil
+}
 
-	if refreshToken.ExpiresAt.Before(time.Now()) {
-		return User{}, ErrNotExist
-	}
+// Removes every refresh token that expired before now,
+// returning how many were removed
+func (db *DB) PurgeExpiredRefreshTokens(now time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *DBStructure) error {
+		expired := []RefreshToken{}
+		for _, refreshToken := range tx.RefreshTokens {
+			if refreshToken.ExpiresAt.Before(now) {
+				expired = append(expired, refreshToken)
+			}
+		}
+
+		for _, refreshToken := range expired {
+			err := tx.apply(walEntry{Op: opTokenRevoked, Token: &refreshToken})
+			if err != nil {
+				return err
+			}
+			purged++
+		}
 
-	user, err := db.GetUserByID(refreshToken.UserID)
+		if purged == 0 {
+			return errRollback
+		}
+		return nil
+	})
 	if err != nil {
-		return User{}, err
+		return 0, err
 	}
 
-	return user, nil
+	return purged, nil
 }
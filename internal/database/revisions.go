@@ -0,0 +1,80 @@
+package database
+
+import (
+	"time"
+)
+
+// one version of a chirp body, numbered from 1 for the original.
+// CreatedAt is when this version was written
+type Revision struct {
+	ChirpID   int       `json:"chirp_id"`
+	Number    int       `json:"number"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// the Revision of the current body of chirp, following the numRevisions
+// replaced ones
+func (chirp Chirp) currentRevision(numRevisions int) Revision {
+	createdAt := chirp.CreatedAt
+	if chirp.EditedAt != nil {
+		createdAt = *chirp.EditedAt
+	}
+	return Revision{
+		ChirpID:   chirp.ID,
+		Number:    numRevisions + 1,
+		Body:      chirp.Body,
+		CreatedAt: createdAt,
+	}
+}
+
+// Replaces the body of a Chirp inside a DB.Update() transaction,
+// keeping the replaced body as a Revision.
+// Returns ErrNotExist if it does not exist and ErrChirpDeleted
+// if it is in the trash
+func (db *DB) EditChirp(id int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		dbChirp, ok := tx.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+		if dbChirp.IsDeleted() {
+			return ErrChirpDeleted
+		}
+
+		replaced := dbChirp.currentRevision(len(tx.Revisions[id]))
+		now := tx.now()
+		chirp = dbChirp
+		chirp.Body = body
+		chirp.Entities = extractEntities(body, tx.userIDByEmail)
+		chirp.UpdatedAt = now
+		chirp.EditedAt = &now
+		return tx.apply(walEntry{Op: opChirpEdited, Chirp: &chirp, Revision: &replaced})
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// Reads every version of a Chirp, oldest first, the current one last.
+// Returns ErrNotExist if the Chirp does not exist
+func (db *DB) GetRevisions(id int) ([]Revision, error) {
+	revisions := []Revision{}
+	err := db.View(func(tx *DBStructure) error {
+		chirp, ok := tx.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+		revisions = append(revisions, tx.Revisions[id]...)
+		revisions = append(revisions, chirp.currentRevision(len(tx.Revisions[id])))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
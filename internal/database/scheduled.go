@@ -0,0 +1,224 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrPublishFailed = errors.New("scheduled chirp can not be published")
+
+// a chirp waiting to be published at PublishAt. It is kept apart from
+// DBStructure.Chirps, so it stays out of every listing until
+// DB.PublishDueChirps() turns it into a regular Chirp.
+// The uploads MediaIDs are reserved for it meanwhile.
+// Error is set when publishing failed, see DB.PublishDueChirps()
+type ScheduledChirp struct {
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	InReplyTo int       `json:"in_reply_to,omitempty"`
+	MediaIDs  []int     `json:"media_ids,omitempty"`
+	PublishAt time.Time `json:"publish_at"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// whether the scheduler still has to publish it
+func (scheduled ScheduledChirp) IsPending() bool {
+	return scheduled.Error == ""
+}
+
+// Schedules a chirp, a reply if parentID is not 0, inside a DB.Update()
+// transaction. Fails like DB.CreateReply() would right now,
+// publishing checks again
+func (db *DB) ScheduleChirp(body string, authorID, parentID int, mediaIDs []int, publishAt time.Time) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		_, _, err := tx.checkChirp(authorID, parentID, mediaIDs, 0)
+		if err != nil {
+			return err
+		}
+
+		now := tx.now()
+		scheduled = ScheduledChirp{
+			ID:        tx.nextScheduledID(),
+			AuthorID:  authorID,
+			Body:      body,
+			InReplyTo: parentID,
+			MediaIDs:  mediaIDs,
+			PublishAt: publishAt.UTC(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		return tx.apply(walEntry{Op: opChirpScheduled, Scheduled: &scheduled})
+	})
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+// Reads the scheduled chirps of one author, failed ones included,
+// the next one to be published first
+func (db *DB) GetScheduledChirps(authorID int) ([]ScheduledChirp, error) {
+	scheduled := []ScheduledChirp{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, s := range tx.Scheduled {
+			if s.AuthorID == authorID {
+				scheduled = append(scheduled, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortScheduled(scheduled)
+	return scheduled, nil
+}
+
+func (db *DB) GetScheduledChirpByID(id int) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	err := db.View(func(tx *DBStructure) error {
+		s, ok := tx.Scheduled[id]
+		if !ok {
+			return ErrNotExist
+		}
+		scheduled = s
+		return nil
+	})
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+// Moves a scheduled chirp to publishAt. A failed one
+// is retried at that time
+func (db *DB) RescheduleChirp(id int, publishAt time.Time) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	err := db.Update(func(tx *DBStructure) error {
+		s, ok := tx.Scheduled[id]
+		if !ok {
+			return ErrNotExist
+		}
+
+		scheduled = s
+		scheduled.PublishAt = publishAt.UTC()
+		scheduled.Error = ""
+		scheduled.UpdatedAt = tx.now()
+		return tx.apply(walEntry{Op: opScheduleChanged, Scheduled: &scheduled})
+	})
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+// Drops a scheduled chirp before it is published,
+// releasing its uploads. Returns ErrNotExist if there is none
+func (db *DB) CancelScheduledChirp(id int) error {
+	return db.Update(func(tx *DBStructure) error {
+		_, ok := tx.Scheduled[id]
+		if !ok {
+			return ErrNotExist
+		}
+		return tx.apply(walEntry{Op: opScheduleRemoved, ID: id})
+	})
+}
+
+// Publishes every pending scheduled chirp due at now, in order of
+// PublishAt, returning how many were published. The chirps are created
+// at the time they are published, not at PublishAt, so they never appear
+// behind a page a client already read.
+// A chirp that can no longer be published, because the chirp it replies
+// to is gone, stays scheduled with Error set until it is rescheduled
+// or cancelled
+func (db *DB) PublishDueChirps(now time.Time) (int, error) {
+	published := 0
+	err := db.Update(func(tx *DBStructure) error {
+		due := []ScheduledChirp{}
+		for _, scheduled := range tx.Scheduled {
+			if scheduled.IsPending() && !scheduled.PublishAt.After(now) {
+				due = append(due, scheduled)
+			}
+		}
+		if len(due) == 0 {
+			return errRollback
+		}
+		sortScheduled(due)
+
+		for _, scheduled := range due {
+			chirp, err := tx.newChirp(scheduled.Body, scheduled.AuthorID, scheduled.InReplyTo, scheduled.MediaIDs, scheduled.ID)
+			if isPublishFailure(err) {
+				scheduled.Error = fmt.Errorf("%w: %w", ErrPublishFailed, err).Error()
+				scheduled.UpdatedAt = tx.now()
+				err = tx.apply(walEntry{Op: opScheduleChanged, Scheduled: &scheduled})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			err = tx.apply(walEntry{Op: opScheduleRemoved, ID: scheduled.ID})
+			if err != nil {
+				return err
+			}
+			err = tx.apply(walEntry{Op: opChirpCreated, Chirp: &chirp})
+			if err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return published, nil
+}
+
+// The PublishAt of the next pending scheduled chirp,
+// the zero time if there is none
+func (db *DB) NextPublishAt() (time.Time, error) {
+	next := time.Time{}
+	err := db.View(func(tx *DBStructure) error {
+		for _, scheduled := range tx.Scheduled {
+			if scheduled.IsPending() && (next.IsZero() || scheduled.PublishAt.Before(next)) {
+				next = scheduled.PublishAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return next, nil
+}
+
+// the errors of checkChirp() that a retry will not fix
+func isPublishFailure(err error) bool {
+	return errors.Is(err, ErrNotExist) || errors.Is(err, ErrReplyToDeleted) || errors.Is(err, ErrMediaUnavailable)
+}
+
+// next to be published first, ties by ID
+func sortScheduled(scheduled []ScheduledChirp) {
+	sort.Slice(scheduled, func(i, j int) bool {
+		if !scheduled[i].PublishAt.Equal(scheduled[j].PublishAt) {
+			return scheduled[i].PublishAt.Before(scheduled[j].PublishAt)
+		}
+		return scheduled[i].ID < scheduled[j].ID
+	})
+}
@@ -0,0 +1,53 @@
+package database
+
+// last IDs handed out per entity. IDs are never reused,
+// even after the entity with the highest ID was deleted
+type Sequences struct {
+	Chirps int `json:"chirps"`
+	Users  int `json:"users"`
+	Media  int `json:"media"`
+	// scheduled chirps get their own IDs,
+	// publishing them takes the next chirp ID
+	Scheduled int `json:"scheduled"`
+}
+
+// advances the chirp sequence and returns the new ID
+func (tx *DBStructure) nextChirpID() int {
+	tx.Sequences.Chirps++
+	return tx.Sequences.Chirps
+}
+
+// advances the media sequence and returns the new ID
+func (tx *DBStructure) nextMediaID() int {
+	tx.Sequences.Media++
+	return tx.Sequences.Media
+}
+
+// advances the scheduled chirp sequence and returns the new ID
+func (tx *DBStructure) nextScheduledID() int {
+	tx.Sequences.Scheduled++
+	return tx.Sequences.Scheduled
+}
+
+// advances the user sequence and returns the new ID
+func (tx *DBStructure) nextUserID() int {
+	tx.Sequences.Users++
+	return tx.Sequences.Users
+}
+
+// raises every sequence to at least the highest ID in use.
+// JSON-DBs written before sequences existed load with all counters at 0
+func (tx *DBStructure) initSequences() {
+	for id := range tx.Chirps {
+		tx.Sequences.Chirps = max(tx.Sequences.Chirps, id)
+	}
+	for id := range tx.Users {
+		tx.Sequences.Users = max(tx.Sequences.Users, id)
+	}
+	for id := range tx.Media {
+		tx.Sequences.Media = max(tx.Sequences.Media, id)
+	}
+	for id := range tx.Scheduled {
+		tx.Sequences.Scheduled = max(tx.Sequences.Scheduled, id)
+	}
+}
@@ -0,0 +1,1403 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// represents the embedded SQLite backend
+type SQLiteDB struct {
+	path string
+	conn *sql.DB
+	opts Options
+
+	// serializes mutations with publishing their events
+	writeMu *sync.Mutex
+	events  *eventHub
+}
+
+// initial schema, applied as migration 1. Later schema changes
+// go into sqliteMigrations, never in here
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	email           TEXT    NOT NULL UNIQUE,
+	hashed_password TEXT    NOT NULL,
+	is_chirpy_red   INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body      TEXT    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token      TEXT     PRIMARY KEY,
+	user_id    INTEGER  NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+`
+
+// NEW SQLITE DB ON SERVER START
+// opens or creates the SQLite file at path and ensures the schema exists
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	return NewSQLiteDBWithOptions(path, Options{})
+}
+
+// NEW SQLITE DB ON SERVER START, tuned by opts.
+// Only Options.Clock applies, the other options tune the JSON-DB
+func NewSQLiteDBWithOptions(path string, opts Options) (*SQLiteDB, error) {
+	db := &SQLiteDB{
+		path:    path,
+		opts:    opts,
+		writeMu: &sync.Mutex{},
+		events:  newEventHub(),
+	}
+	err := db.open()
+	return db, err
+}
+
+// the current time in UTC, as told by Options.Clock
+func (db *SQLiteDB) now() time.Time {
+	if db.opts.Clock == nil {
+		return time.Now().UTC()
+	}
+	return db.opts.Clock().UTC()
+}
+
+// opens the connection pool and applies pending migrations.
+// _txlock=immediate makes every transaction take the write lock up front,
+// so concurrent read-modify-write cycles serialize instead of deadlocking
+func (db *SQLiteDB) open() error {
+	conn, err := sql.Open("sqlite3", "file:"+db.path+"?_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return err
+	}
+
+	db.conn = conn
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// runs fn inside a transaction, committing on success and rolling back on error
+func (db *SQLiteDB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) ResetDB() error {
+	err := db.conn.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err = os.Remove(db.path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return db.open()
+}
+
+func (db *SQLiteDB) Close() error {
+	db.events.closeAll()
+	return db.conn.Close()
+}
+
+// CHIRPS
+
+func (db *SQLiteDB) CreateChirp(body string, authorID int, mediaIDs []int) (Chirp, error) {
+	return db.createChirp(body, authorID, 0, mediaIDs)
+}
+
+func (db *SQLiteDB) CreateReply(body string, authorID, parentID int, mediaIDs []int) (Chirp, error) {
+	return db.createChirp(body, authorID, parentID, mediaIDs)
+}
+
+func (db *SQLiteDB) createChirp(body string, authorID, parentID int, mediaIDs []int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		var err error
+		chirp, err = db.insertChirp(tx, body, authorID, parentID, mediaIDs, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventChirpCreated, ID: chirp.ID, Chirp: &chirp}}, nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// same rules as DBStructure.checkChirp()
+func sqliteCheckChirp(tx *sql.Tx, authorID, parentID int, mediaIDs []int, scheduledID int) (int, []Media, error) {
+	rootID := 0
+	if parentID != 0 {
+		parent, err := scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, parentID))
+		if err != nil {
+			return 0, nil, err
+		}
+		if parent.IsDeleted() {
+			return 0, nil, ErrReplyToDeleted
+		}
+		rootID = parent.threadRoot()
+	}
+	media, err := sqliteAttachableMedia(tx, mediaIDs, authorID, scheduledID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rootID, media, nil
+}
+
+// inserts the next chirp after sqliteCheckChirp(), with its entities and media
+func (db *SQLiteDB) insertChirp(tx *sql.Tx, body string, authorID, parentID int, mediaIDs []int, scheduledID int) (Chirp, error) {
+	rootID, media, err := sqliteCheckChirp(tx, authorID, parentID, mediaIDs, scheduledID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	now := db.now()
+	chirp := Chirp{
+		AuthorID:  authorID,
+		Body:      body,
+		InReplyTo: parentID,
+		RootID:    rootID,
+		Entities:  extractEntities(body, sqliteUserIDByEmail(tx)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	entities, err := jsonColumn(chirp.Entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+	result, err := tx.Exec(
+		`INSERT INTO chirps (author_id, body, in_reply_to, root_id, entities, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		authorID, body, nullableID(parentID), nullableID(rootID), entities, now, now,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.ID = int(id)
+
+	err = writeEntities(tx, chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = attachMedia(tx, &chirp, media)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+const sqliteChirpColumns = `id, author_id, body, in_reply_to, root_id, entities, media, created_at, updated_at, edited_at, deleted_at`
+
+// chirps not in a thread store NULL instead of the ID 0
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// Binds a list of IDs as one JSON array parameter, used with
+// IN (SELECT value FROM json_each(?)). A placeholder per ID runs into
+// SQLite's limit on variables for long lists
+func jsonIDs(ids []int) (string, error) {
+	data, err := json.Marshal(ids)
+	return string(data), err
+}
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	chirp := Chirp{}
+	inReplyTo := sql.NullInt64{}
+	rootID := sql.NullInt64{}
+	entities := sql.NullString{}
+	media := sql.NullString{}
+	editedAt := sql.NullTime{}
+	deletedAt := sql.NullTime{}
+	err := row.Scan(&chirp.ID, &chirp.AuthorID, &chirp.Body, &inReplyTo, &rootID, &entities, &media, &chirp.CreatedAt, &chirp.UpdatedAt, &editedAt, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotExist
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.InReplyTo = int(inReplyTo.Int64)
+	chirp.RootID = int(rootID.Int64)
+	if entities.Valid {
+		err = json.Unmarshal([]byte(entities.String), &chirp.Entities)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	if media.Valid {
+		err = json.Unmarshal([]byte(media.String), &chirp.Media)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	if editedAt.Valid {
+		chirp.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	return chirp, nil
+}
+
+// entities and media are stored as JSON, NULL when there are none
+func jsonColumn[T any](values []T) (sql.NullString, error) {
+	if len(values) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// replaces the rows of chirp in the chirp_tags and chirp_mentions lookup tables
+func writeEntities(tx *sql.Tx, chirp Chirp) error {
+	for _, table := range []string{"chirp_tags", "chirp_mentions"} {
+		_, err := tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ?`, chirp.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entity := range chirp.Entities {
+		var err error
+		switch entity.Type {
+		case EntityHashtag:
+			_, err = tx.Exec(`INSERT OR IGNORE INTO chirp_tags (tag, chirp_id) VALUES (?, ?)`, entity.Tag, chirp.ID)
+		case EntityMention:
+			_, err = tx.Exec(`INSERT OR IGNORE INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)`, entity.UserID, chirp.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolves mentions inside tx
+func sqliteUserIDByEmail(tx *sql.Tx) func(email string) (int, bool) {
+	return func(email string) (int, bool) {
+		id := 0
+		err := tx.QueryRow(`SELECT id FROM users WHERE email = ? COLLATE NOCASE`, email).Scan(&id)
+		return id, err == nil
+	}
+}
+
+func (db *SQLiteDB) GetChirpsByTag(tag string) ([]Chirp, error) {
+	return db.queryChirps(
+		`SELECT `+sqliteChirpColumns+` FROM chirps
+		WHERE deleted_at IS NULL
+		AND id IN (SELECT chirp_id FROM chirp_tags WHERE tag = ?)`,
+		TagKey(tag),
+	)
+}
+
+func (db *SQLiteDB) GetMentions(userID int) ([]Chirp, error) {
+	return db.queryChirps(
+		`SELECT `+sqliteChirpColumns+` FROM chirps
+		WHERE deleted_at IS NULL
+		AND id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)`,
+		userID,
+	)
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return db.queryChirps(`SELECT ` + sqliteChirpColumns + ` FROM chirps WHERE deleted_at IS NULL`)
+}
+
+func (db *SQLiteDB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	return db.queryChirps(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE author_id = ? AND deleted_at IS NULL`, authorID)
+}
+
+func (db *SQLiteDB) GetDeletedChirps(authorID int) ([]Chirp, error) {
+	return db.queryChirps(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE author_id = ? AND deleted_at IS NOT NULL`, authorID)
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirpByID(id int) (Chirp, error) {
+	return scanChirp(db.conn.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, id))
+}
+
+func (db *SQLiteDB) GetThread(id int) ([]Chirp, error) {
+	chirp, err := db.GetChirpByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rootID := chirp.threadRoot()
+	return db.queryChirps(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ? OR root_id = ?`, rootID, rootID)
+}
+
+func (db *SQLiteDB) GetReplyCounts(ids []int) (map[int]int, error) {
+	counts := map[int]int{}
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	idList, err := jsonIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.conn.Query(
+		`SELECT in_reply_to, COUNT(*) FROM chirps
+		WHERE deleted_at IS NULL AND in_reply_to IN (SELECT value FROM json_each(?))
+		GROUP BY in_reply_to`,
+		idList,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, count int
+		err = rows.Scan(&id, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (db *SQLiteDB) EditChirp(id int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		dbChirp, err := scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		if dbChirp.IsDeleted() {
+			return nil, ErrChirpDeleted
+		}
+
+		numRevisions := 0
+		err = tx.QueryRow(`SELECT COUNT(*) FROM chirp_revisions WHERE chirp_id = ?`, id).Scan(&numRevisions)
+		if err != nil {
+			return nil, err
+		}
+		replaced := dbChirp.currentRevision(numRevisions)
+		_, err = tx.Exec(
+			`INSERT INTO chirp_revisions (chirp_id, number, body, created_at) VALUES (?, ?, ?, ?)`,
+			id, replaced.Number, replaced.Body, replaced.CreatedAt.UTC(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		now := db.now()
+		chirp = dbChirp
+		chirp.Body = body
+		chirp.Entities = extractEntities(body, sqliteUserIDByEmail(tx))
+		chirp.UpdatedAt = now
+		chirp.EditedAt = &now
+		entities, err := jsonColumn(chirp.Entities)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(
+			`UPDATE chirps SET body = ?, entities = ?, updated_at = ?, edited_at = ? WHERE id = ?`,
+			body, entities, now, now, id,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = writeEntities(tx, chirp)
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventChirpEdited, ID: id, Chirp: &chirp}}, nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) GetRevisions(id int) ([]Revision, error) {
+	revisions := []Revision{}
+	err := db.withTx(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, id))
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT chirp_id, number, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY number`, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			revision := Revision{}
+			err = rows.Scan(&revision.ChirpID, &revision.Number, &revision.Body, &revision.CreatedAt)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		revisions = append(revisions, chirp.currentRevision(len(revisions)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (db *SQLiteDB) DeleteChirp(id int) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		result, err := tx.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, db.now(), id)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		return []Event{{Type: EventChirpDeleted, ID: id}}, nil
+	})
+}
+
+func (db *SQLiteDB) RestoreChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		result, err := tx.Exec(`UPDATE chirps SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNotExist
+		}
+
+		chirp, err = scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventChirpRestored, ID: id, Chirp: &chirp}}, nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) PurgeDeletedChirps(before time.Time) (int, error) {
+	purged := 0
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		rows, err := tx.Query(`SELECT id FROM chirps WHERE deleted_at < ?`, before.UTC())
+		if err != nil {
+			return nil, err
+		}
+		events := []Event{}
+		for rows.Next() {
+			event := Event{Type: EventChirpPurged}
+			err = rows.Scan(&event.ID)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+
+		for _, table := range []string{"likes", "rechirps", "chirp_revisions", "chirp_tags", "chirp_mentions", "media"} {
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE chirp_id IN (SELECT id FROM chirps WHERE deleted_at < ?)`, before.UTC())
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM chirps WHERE deleted_at < ?`, before.UTC())
+		if err != nil {
+			return nil, err
+		}
+		purged = len(events)
+		return events, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// USERS
+
+const sqliteUserColumns = `id, email, hashed_password, is_chirpy_red, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	err := row.Scan(&user.ID, &user.Email, &user.HashedPassword, &user.IsChirpyRed, &user.CreatedAt, &user.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExist
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) CreateUser(email string, hashedPassword string) (User, error) {
+	user := User{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		now := db.now()
+		result, err := tx.Exec(
+			`INSERT INTO users (email, hashed_password, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+			email, hashedPassword, now, now,
+		)
+		if isUniqueViolation(err) {
+			return nil, ErrAlreadyExists
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		user = User{
+			ID:             int(id),
+			Email:          email,
+			HashedPassword: hashedPassword,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		return []Event{{Type: EventUserCreated, ID: user.ID, User: publicUser(user)}}, nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) GetUserByID(id int) (User, error) {
+	return scanUser(db.conn.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, id))
+}
+
+func (db *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return scanUser(db.conn.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE email = ? COLLATE NOCASE`, email))
+}
+
+func (db *SQLiteDB) GetUsers() ([]User, error) {
+	rows, err := db.conn.Query(`SELECT ` + sqliteUserColumns + ` FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (db *SQLiteDB) UpdateUser(id int, email, hashedPassword string) (User, error) {
+	user := User{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		result, err := tx.Exec(`UPDATE users SET email = ?, hashed_password = ?, updated_at = ? WHERE id = ?`, email, hashedPassword, db.now(), id)
+		if isUniqueViolation(err) {
+			return nil, ErrAlreadyExists
+		}
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNotExist
+		}
+
+		user, err = scanUser(tx.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventUserUpdated, ID: id, User: publicUser(user)}}, nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) UpgradeChirpyRed(id int) (User, error) {
+	user := User{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		result, err := tx.Exec(`UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?`, db.now(), id)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNotExist
+		}
+
+		user, err = scanUser(tx.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventUserUpgraded, ID: id}}, nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// REFRESH TOKENS
+
+func (db *SQLiteDB) SaveRefreshToken(userID int, token string) error {
+	_, err := db.conn.Exec(
+		`INSERT OR REPLACE INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`,
+		token, userID, db.now().Add(time.Hour),
+	)
+	return err
+}
+
+func (db *SQLiteDB) RevokeRefreshToken(token string) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		return deleteRefreshTokens(tx, `WHERE token = ?`, token)
+	})
+}
+
+func (db *SQLiteDB) PurgeExpiredRefreshTokens(now time.Time) (int, error) {
+	purged := 0
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		events, err := deleteRefreshTokens(tx, `WHERE expires_at < ?`, now.UTC())
+		purged = len(events)
+		return events, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// deletes the refresh tokens matching where, one EventTokenRevoked each
+func deleteRefreshTokens(tx *sql.Tx, where string, args ...any) ([]Event, error) {
+	rows, err := tx.Query(`SELECT token, user_id FROM refresh_tokens `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{}
+	for rows.Next() {
+		event := Event{Type: EventTokenRevoked}
+		err = rows.Scan(&event.Token, &event.UserID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	_, err = tx.Exec(`DELETE FROM refresh_tokens `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (db *SQLiteDB) UserForRefreshToken(token string) (User, error) {
+	refreshToken := RefreshToken{}
+	err := db.conn.QueryRow(`SELECT token, user_id, expires_at FROM refresh_tokens WHERE token = ?`, token).
+		Scan(&refreshToken.Token, &refreshToken.UserID, &refreshToken.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExist
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if refreshToken.ExpiresAt.Before(db.now()) {
+		return User{}, ErrNotExist
+	}
+
+	return db.GetUserByID(refreshToken.UserID)
+}
+
+// FOLLOWS
+
+func (db *SQLiteDB) FollowUser(followerID, followeeID int) (Follow, error) {
+	follow := Follow{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		if followerID == followeeID {
+			return nil, ErrSelfFollow
+		}
+		for _, id := range []int{followerID, followeeID} {
+			_, err := scanUser(tx.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, id))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		follow = Follow{FollowerID: followerID, FolloweeID: followeeID}
+		err := tx.QueryRow(
+			`SELECT created_at FROM follows WHERE follower_id = ? AND followee_id = ?`,
+			followerID, followeeID,
+		).Scan(&follow.CreatedAt)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		follow.CreatedAt = db.now()
+		_, err = tx.Exec(
+			`INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`,
+			followerID, followeeID, follow.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: EventUserFollowed, Follow: &follow}}, nil
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+func (db *SQLiteDB) UnfollowUser(followerID, followeeID int) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		result, err := tx.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerID, followeeID)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		return []Event{{Type: EventUserUnfollowed, Follow: &Follow{FollowerID: followerID, FolloweeID: followeeID}}}, nil
+	})
+}
+
+func (db *SQLiteDB) GetFollowers(userID int) ([]Follow, error) {
+	return db.queryFollows(`SELECT follower_id, followee_id, created_at FROM follows WHERE followee_id = ?`, userID)
+}
+
+func (db *SQLiteDB) GetFollowing(userID int) ([]Follow, error) {
+	return db.queryFollows(`SELECT follower_id, followee_id, created_at FROM follows WHERE follower_id = ?`, userID)
+}
+
+func (db *SQLiteDB) queryFollows(query string, args ...any) ([]Follow, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+	for rows.Next() {
+		follow := Follow{}
+		err = rows.Scan(&follow.FollowerID, &follow.FolloweeID, &follow.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		follows = append(follows, follow)
+	}
+
+	return follows, rows.Err()
+}
+
+func (db *SQLiteDB) GetTimeline(userID int) ([]Chirp, error) {
+	return db.queryChirps(
+		`SELECT `+sqliteChirpColumns+` FROM chirps
+		WHERE deleted_at IS NULL
+		AND author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)`,
+		userID,
+	)
+}
+
+// REACTIONS
+
+// the table holding the reactions of each kind
+var reactionTables = map[ReactionKind]string{
+	ReactionLike:    "likes",
+	ReactionRechirp: "rechirps",
+}
+
+func (db *SQLiteDB) React(kind ReactionKind, chirpID, userID int) error {
+	table, ok := reactionTables[kind]
+	if !ok {
+		return ErrUnknownReaction
+	}
+
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		chirp, err := scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, chirpID))
+		if err != nil {
+			return nil, err
+		}
+		if chirp.IsDeleted() {
+			return nil, ErrChirpDeleted
+		}
+		_, err = scanUser(tx.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, userID))
+		if err != nil {
+			return nil, err
+		}
+
+		reaction := Reaction{Kind: kind, ChirpID: chirpID, UserID: userID, CreatedAt: db.now()}
+		result, err := tx.Exec(
+			`INSERT OR IGNORE INTO `+table+` (chirp_id, user_id, created_at) VALUES (?, ?, ?)`,
+			chirpID, userID, reaction.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		return []Event{{Type: reactionEventTypes[kind][0], ID: chirpID, Reaction: &reaction}}, nil
+	})
+}
+
+func (db *SQLiteDB) Unreact(kind ReactionKind, chirpID, userID int) error {
+	table, ok := reactionTables[kind]
+	if !ok {
+		return ErrUnknownReaction
+	}
+
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		chirp, err := scanChirp(tx.QueryRow(`SELECT `+sqliteChirpColumns+` FROM chirps WHERE id = ?`, chirpID))
+		if err != nil {
+			return nil, err
+		}
+		if chirp.IsDeleted() {
+			return nil, ErrChirpDeleted
+		}
+
+		result, err := tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ? AND user_id = ?`, chirpID, userID)
+		if err != nil {
+			return nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		reaction := Reaction{Kind: kind, ChirpID: chirpID, UserID: userID}
+		return []Event{{Type: reactionEventTypes[kind][1], ID: chirpID, Reaction: &reaction}}, nil
+	})
+}
+
+func (db *SQLiteDB) GetReactionCounts(ids []int, userID int) (map[int]ReactionCounts, error) {
+	counts := map[int]ReactionCounts{}
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	idList, err := jsonIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// one row per reaction kind and chirp, mine tells if userID is among them.
+	// Numbered parameters, so both halves of the query share them
+	rows, err := db.conn.Query(
+		`SELECT 'like', chirp_id, COUNT(*), MAX(user_id = ?1) FROM likes
+		WHERE chirp_id IN (SELECT value FROM json_each(?2)) GROUP BY chirp_id
+		UNION ALL
+		SELECT 'rechirp', chirp_id, COUNT(*), MAX(user_id = ?1) FROM rechirps
+		WHERE chirp_id IN (SELECT value FROM json_each(?2)) GROUP BY chirp_id`,
+		userID, idList,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind ReactionKind
+		var id, count int
+		var mine bool
+		err = rows.Scan(&kind, &id, &count, &mine)
+		if err != nil {
+			return nil, err
+		}
+
+		chirpCounts := counts[id]
+		switch kind {
+		case ReactionLike:
+			chirpCounts.Likes = count
+			chirpCounts.LikedByMe = mine
+		case ReactionRechirp:
+			chirpCounts.Rechirps = count
+			chirpCounts.RechirpedByMe = mine
+		}
+		counts[id] = chirpCounts
+	}
+
+	return counts, rows.Err()
+}
+
+// MEDIA
+
+const sqliteMediaColumns = `id, owner_id, chirp_id, key, content_type, size, created_at`
+
+func scanMedia(row rowScanner) (Media, error) {
+	media := Media{}
+	chirpID := sql.NullInt64{}
+	err := row.Scan(&media.ID, &media.OwnerID, &chirpID, &media.Key, &media.ContentType, &media.Size, &media.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Media{}, ErrNotExist
+	}
+	if err != nil {
+		return Media{}, err
+	}
+	media.ChirpID = int(chirpID.Int64)
+	return media, nil
+}
+
+func (db *SQLiteDB) CreateMedia(ownerID int, key, contentType string, size int64) (Media, error) {
+	media := Media{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		_, err := scanUser(tx.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, ownerID))
+		if err != nil {
+			return nil, err
+		}
+
+		media = Media{
+			OwnerID:     ownerID,
+			Key:         key,
+			ContentType: contentType,
+			Size:        size,
+			CreatedAt:   db.now(),
+		}
+		result, err := tx.Exec(
+			`INSERT INTO media (owner_id, key, content_type, size, created_at) VALUES (?, ?, ?, ?, ?)`,
+			ownerID, key, contentType, size, media.CreatedAt,
+		)
+		if isUniqueViolation(err) {
+			return nil, ErrMediaKeyTaken
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		media.ID = int(id)
+		// uploads are not published, see walEntry.event()
+		return nil, nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+
+	return media, nil
+}
+
+func (db *SQLiteDB) GetMediaByKey(key string) (Media, error) {
+	return scanMedia(db.conn.QueryRow(`SELECT `+sqliteMediaColumns+` FROM media WHERE key = ?`, key))
+}
+
+func (db *SQLiteDB) PurgeOrphanedMedia(before time.Time) ([]Media, error) {
+	purged := []Media{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		rows, err := tx.Query(`SELECT `+sqliteMediaColumns+` FROM media WHERE chirp_id IS NULL AND created_at < ? AND id NOT IN (SELECT media_id FROM scheduled_media)`, before.UTC())
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			media, err := scanMedia(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			purged = append(purged, media)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+
+		_, err = tx.Exec(`DELETE FROM media WHERE chirp_id IS NULL AND created_at < ? AND id NOT IN (SELECT media_id FROM scheduled_media)`, before.UTC())
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// same rules as DBStructure.attachableMedia()
+func sqliteAttachableMedia(tx *sql.Tx, mediaIDs []int, authorID int, scheduledID int) ([]Media, error) {
+	var attached []Media
+	seen := map[int]struct{}{}
+	for _, id := range mediaIDs {
+		media, err := scanMedia(tx.QueryRow(`SELECT `+sqliteMediaColumns+` FROM media WHERE id = ?`, id))
+		if errors.Is(err, ErrNotExist) {
+			return nil, ErrMediaUnavailable
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, ok := seen[id]
+		if media.OwnerID != authorID || media.ChirpID != 0 || ok {
+			return nil, ErrMediaUnavailable
+		}
+		reservedBy := 0
+		err = tx.QueryRow(`SELECT scheduled_id FROM scheduled_media WHERE media_id = ?`, id).Scan(&reservedBy)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if err == nil && reservedBy != scheduledID {
+			return nil, ErrMediaUnavailable
+		}
+		seen[id] = struct{}{}
+		attached = append(attached, media)
+	}
+	return attached, nil
+}
+
+// points media at the freshly inserted chirp and stores the copies in chirps.media
+func attachMedia(tx *sql.Tx, chirp *Chirp, media []Media) error {
+	if len(media) == 0 {
+		return nil
+	}
+
+	for i := range media {
+		media[i].ChirpID = chirp.ID
+		_, err := tx.Exec(`UPDATE media SET chirp_id = ? WHERE id = ?`, chirp.ID, media[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	column, err := jsonColumn(media)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET media = ? WHERE id = ?`, column, chirp.ID)
+	if err != nil {
+		return err
+	}
+	chirp.Media = media
+	return nil
+}
+
+// SCHEDULED CHIRPS
+
+const sqliteScheduledColumns = `id, author_id, body, in_reply_to, media_ids, publish_at, error, created_at, updated_at`
+
+func scanScheduled(row rowScanner) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	inReplyTo := sql.NullInt64{}
+	mediaIDs := sql.NullString{}
+	publishErr := sql.NullString{}
+	err := row.Scan(&scheduled.ID, &scheduled.AuthorID, &scheduled.Body, &inReplyTo, &mediaIDs, &scheduled.PublishAt, &publishErr, &scheduled.CreatedAt, &scheduled.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScheduledChirp{}, ErrNotExist
+	}
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+	scheduled.InReplyTo = int(inReplyTo.Int64)
+	scheduled.Error = publishErr.String
+	if mediaIDs.Valid {
+		err = json.Unmarshal([]byte(mediaIDs.String), &scheduled.MediaIDs)
+		if err != nil {
+			return ScheduledChirp{}, err
+		}
+	}
+	return scheduled, nil
+}
+
+// Inserts scheduled and reserves its uploads in scheduled_media.
+// A scheduled chirp without ID gets the next one
+func insertScheduled(tx *sql.Tx, scheduled *ScheduledChirp) error {
+	mediaIDs, err := jsonColumn(scheduled.MediaIDs)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		`INSERT INTO scheduled_chirps (`+sqliteScheduledColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		nullableID(scheduled.ID), scheduled.AuthorID, scheduled.Body, nullableID(scheduled.InReplyTo), mediaIDs,
+		scheduled.PublishAt, sql.NullString{String: scheduled.Error, Valid: scheduled.Error != ""},
+		scheduled.CreatedAt, scheduled.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	scheduled.ID = int(id)
+	for _, mediaID := range scheduled.MediaIDs {
+		_, err = tx.Exec(`INSERT INTO scheduled_media (media_id, scheduled_id) VALUES (?, ?)`, mediaID, scheduled.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes a scheduled chirp and releases its uploads
+func deleteScheduled(tx *sql.Tx, id int) error {
+	_, err := tx.Exec(`DELETE FROM scheduled_media WHERE scheduled_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM scheduled_chirps WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLiteDB) ScheduleChirp(body string, authorID, parentID int, mediaIDs []int, publishAt time.Time) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		_, _, err := sqliteCheckChirp(tx, authorID, parentID, mediaIDs, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		now := db.now()
+		scheduled = ScheduledChirp{
+			AuthorID:  authorID,
+			Body:      body,
+			InReplyTo: parentID,
+			MediaIDs:  mediaIDs,
+			PublishAt: publishAt.UTC(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		err = insertScheduled(tx, &scheduled)
+		if err != nil {
+			return nil, err
+		}
+		// scheduled chirps are not published, see walEntry.event()
+		return nil, nil
+	})
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+func (db *SQLiteDB) GetScheduledChirps(authorID int) ([]ScheduledChirp, error) {
+	return queryScheduled(db.conn,
+		`SELECT `+sqliteScheduledColumns+` FROM scheduled_chirps WHERE author_id = ? ORDER BY publish_at, id`,
+		authorID,
+	)
+}
+
+func (db *SQLiteDB) GetScheduledChirpByID(id int) (ScheduledChirp, error) {
+	return scanScheduled(db.conn.QueryRow(`SELECT `+sqliteScheduledColumns+` FROM scheduled_chirps WHERE id = ?`, id))
+}
+
+// reads the scheduled chirps of query, on the pool or inside a transaction
+func queryScheduled(q interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}, query string, args ...any) ([]ScheduledChirp, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := []ScheduledChirp{}
+	for rows.Next() {
+		s, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, s)
+	}
+
+	return scheduled, rows.Err()
+}
+
+func (db *SQLiteDB) RescheduleChirp(id int, publishAt time.Time) (ScheduledChirp, error) {
+	scheduled := ScheduledChirp{}
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		var err error
+		scheduled, err = scanScheduled(tx.QueryRow(`SELECT `+sqliteScheduledColumns+` FROM scheduled_chirps WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+
+		scheduled.PublishAt = publishAt.UTC()
+		scheduled.Error = ""
+		scheduled.UpdatedAt = db.now()
+		_, err = tx.Exec(
+			`UPDATE scheduled_chirps SET publish_at = ?, error = NULL, updated_at = ? WHERE id = ?`,
+			scheduled.PublishAt, scheduled.UpdatedAt, id,
+		)
+		return nil, err
+	})
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+func (db *SQLiteDB) CancelScheduledChirp(id int) error {
+	return db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		_, err := scanScheduled(tx.QueryRow(`SELECT `+sqliteScheduledColumns+` FROM scheduled_chirps WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+		return nil, deleteScheduled(tx, id)
+	})
+}
+
+// same rules as DB.PublishDueChirps()
+func (db *SQLiteDB) PublishDueChirps(now time.Time) (int, error) {
+	published := 0
+	err := db.mutate(func(tx *sql.Tx) ([]Event, error) {
+		due, err := queryScheduled(tx,
+			`SELECT `+sqliteScheduledColumns+` FROM scheduled_chirps WHERE error IS NULL AND publish_at <= ? ORDER BY publish_at, id`,
+			now.UTC(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events := []Event{}
+		for _, scheduled := range due {
+			chirp, err := db.insertChirp(tx, scheduled.Body, scheduled.AuthorID, scheduled.InReplyTo, scheduled.MediaIDs, scheduled.ID)
+			if isPublishFailure(err) {
+				_, err = tx.Exec(
+					`UPDATE scheduled_chirps SET error = ?, updated_at = ? WHERE id = ?`,
+					fmt.Errorf("%w: %w", ErrPublishFailed, err).Error(), db.now(), scheduled.ID,
+				)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			err = deleteScheduled(tx, scheduled.ID)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, Event{Type: EventChirpCreated, ID: chirp.ID, Chirp: &chirp})
+			published++
+		}
+		return events, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return published, nil
+}
+
+func (db *SQLiteDB) NextPublishAt() (time.Time, error) {
+	next := time.Time{}
+	err := db.conn.QueryRow(
+		`SELECT publish_at FROM scheduled_chirps WHERE error IS NULL ORDER BY publish_at LIMIT 1`,
+	).Scan(&next)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return next, nil
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Runs fn in a transaction, journals the events it returns in the
+// events table and publishes them to subscribers once committed
+func (db *SQLiteDB) mutate(fn func(tx *sql.Tx) ([]Event, error)) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	events := []Event{}
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		events, err = fn(tx)
+		if err != nil {
+			return err
+		}
+		return journalEvents(tx, events, db.now())
+	})
+	if err != nil {
+		return err
+	}
+
+	db.events.publish(events)
+	return nil
+}
+
+// inserts events, assigning their Cursor and Time,
+// and trims the journal back to eventRetention
+func journalEvents(tx *sql.Tx, events []Event, now time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	for i := range events {
+		events[i].Time = now
+		payload, err := json.Marshal(events[i])
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`INSERT INTO events (payload) VALUES (?)`, payload)
+		if err != nil {
+			return err
+		}
+		events[i].Cursor, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+	}
+
+	last := events[len(events)-1].Cursor
+	_, err := tx.Exec(`DELETE FROM events WHERE cursor <= ?`, last-eventRetention)
+	return err
+}
+
+// Subscribes to changes after the given cursor, see DB.Subscribe()
+func (db *SQLiteDB) Subscribe(after int64) (*Subscription, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	latest := int64(0)
+	err := db.conn.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'events'`).Scan(&latest)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// everything up to the horizon was trimmed or wiped by a restore
+	horizon := latest
+	oldest := sql.NullInt64{}
+	err = db.conn.QueryRow(`SELECT MIN(cursor) FROM events`).Scan(&oldest)
+	if err != nil {
+		return nil, err
+	}
+	if oldest.Valid {
+		horizon = oldest.Int64 - 1
+	}
+
+	if after == 0 {
+		after = horizon
+	}
+	if after == FromNow || after >= latest {
+		return db.events.subscribe(nil), nil
+	}
+	if after < horizon {
+		return nil, ErrCursorExpired
+	}
+
+	rows, err := db.conn.Query(`SELECT cursor, payload FROM events WHERE cursor > ? ORDER BY cursor`, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backlog := []Event{}
+	for rows.Next() {
+		cursor, payload := int64(0), []byte{}
+		err = rows.Scan(&cursor, &payload)
+		if err != nil {
+			return nil, err
+		}
+
+		event := Event{}
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return nil, err
+		}
+		event.Cursor = cursor
+		backlog = append(backlog, event)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return db.events.subscribe(backlog), nil
+}
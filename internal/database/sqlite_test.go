@@ -0,0 +1,77 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// more IDs than SQLite accepts as bound variables in one statement
+const manyIDs = 40_000
+
+func openSQLite(t *testing.T) *SQLiteDB {
+	t.Helper()
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.sqlite"))
+	if err != nil {
+		t.Fatalf("could not open sqlite database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// counts of a long timeline page must not run into the variable limit
+func TestGetReplyCountsManyIDs(t *testing.T) {
+	db := openSQLite(t)
+	author, err := db.CreateUser("author@example.com", "hash")
+	if err != nil {
+		t.Fatalf("could not create author: %s", err)
+	}
+	parent, err := db.CreateChirp("parent", author.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create chirp: %s", err)
+	}
+	_, err = db.CreateReply("reply", author.ID, parent.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create reply: %s", err)
+	}
+
+	ids := make([]int, manyIDs)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	counts, err := db.GetReplyCounts(ids)
+	if err != nil {
+		t.Fatalf("could not get reply counts: %s", err)
+	}
+	if len(counts) != 1 || counts[parent.ID] != 1 {
+		t.Errorf("got counts %v, want one reply to chirp %d", counts, parent.ID)
+	}
+}
+
+func TestGetReactionCountsManyIDs(t *testing.T) {
+	db := openSQLite(t)
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	chirp, err := db.CreateChirp("liked", user.ID, nil)
+	if err != nil {
+		t.Fatalf("could not create chirp: %s", err)
+	}
+	err = db.React(ReactionLike, chirp.ID, user.ID)
+	if err != nil {
+		t.Fatalf("could not like chirp: %s", err)
+	}
+
+	ids := make([]int, manyIDs)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	counts, err := db.GetReactionCounts(ids, user.ID)
+	if err != nil {
+		t.Fatalf("could not get reaction counts: %s", err)
+	}
+	want := ReactionCounts{Likes: 1, LikedByMe: true}
+	if len(counts) != 1 || counts[chirp.ID] != want {
+		t.Errorf("got counts %v, want %v for chirp %d", counts, want, chirp.ID)
+	}
+}
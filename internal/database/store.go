@@ -0,0 +1,74 @@
+package database
+
+import (
+	"io"
+	"time"
+)
+
+// Store is the set of storage operations the handlers depend on.
+// The JSON file backed *DB and the embedded *SQLiteDB both implement it,
+// so the backend can be chosen at server start without touching handlers.
+type Store interface {
+	CreateChirp(body string, authorID int, mediaIDs []int) (Chirp, error)
+	CreateReply(body string, authorID, parentID int, mediaIDs []int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(authorID int) ([]Chirp, error)
+	GetChirpByID(id int) (Chirp, error)
+	DeleteChirp(id int) error
+	GetDeletedChirps(authorID int) ([]Chirp, error)
+	RestoreChirp(id int) (Chirp, error)
+	PurgeDeletedChirps(before time.Time) (int, error)
+	GetThread(id int) ([]Chirp, error)
+	GetReplyCounts(ids []int) (map[int]int, error)
+	EditChirp(id int, body string) (Chirp, error)
+	GetRevisions(id int) ([]Revision, error)
+	GetChirpsByTag(tag string) ([]Chirp, error)
+	GetMentions(userID int) ([]Chirp, error)
+	React(kind ReactionKind, chirpID, userID int) error
+	Unreact(kind ReactionKind, chirpID, userID int) error
+	GetReactionCounts(ids []int, userID int) (map[int]ReactionCounts, error)
+
+	CreateMedia(ownerID int, key, contentType string, size int64) (Media, error)
+	GetMediaByKey(key string) (Media, error)
+	PurgeOrphanedMedia(before time.Time) ([]Media, error)
+
+	ScheduleChirp(body string, authorID, parentID int, mediaIDs []int, publishAt time.Time) (ScheduledChirp, error)
+	GetScheduledChirps(authorID int) ([]ScheduledChirp, error)
+	GetScheduledChirpByID(id int) (ScheduledChirp, error)
+	RescheduleChirp(id int, publishAt time.Time) (ScheduledChirp, error)
+	CancelScheduledChirp(id int) error
+	PublishDueChirps(now time.Time) (int, error)
+	NextPublishAt() (time.Time, error)
+
+	CreateUser(email string, hashedPassword string) (User, error)
+	GetUserByID(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUsers() ([]User, error)
+	UpdateUser(id int, email, hashedPassword string) (User, error)
+	UpgradeChirpyRed(id int) (User, error)
+
+	SaveRefreshToken(userID int, token string) error
+	RevokeRefreshToken(token string) error
+	UserForRefreshToken(token string) (User, error)
+	PurgeExpiredRefreshTokens(now time.Time) (int, error)
+
+	FollowUser(followerID, followeeID int) (Follow, error)
+	UnfollowUser(followerID, followeeID int) error
+	GetFollowers(userID int) ([]Follow, error)
+	GetFollowing(userID int) ([]Follow, error)
+	GetTimeline(userID int) ([]Chirp, error)
+
+	Subscribe(after int64) (*Subscription, error)
+
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+
+	ResetDB() error
+	Close() error
+}
+
+// compile time checks that both backends satisfy Store
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
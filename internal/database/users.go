@@ -2,37 +2,77 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// CreatedAt and UpdatedAt are set by the database, from Options.Clock
 type User struct {
-	ID             int    `json:"id"`
-	Email          string `json:"email"`
-	HashedPassword string `json:"hashed_password"`
-	IsChirpyRed    bool   `json:"is_chirpy_red"`
+	ID             int       `json:"id"`
+	Email          string    `json:"email"`
+	HashedPassword string    `json:"hashed_password"`
+	IsChirpyRed    bool      `json:"is_chirpy_red"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
 var ErrAlreadyExists = errors.New("already exists")
-
-func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
-	_, err := db.GetUserByEmail(email)
-	if !errors.Is(err, ErrNotExist) {
-		return User{}, ErrAlreadyExists
+var ErrDuplicateEmails = errors.New("emails of different users only differ in case, change all but one of them")
+
+// Reports users whose emails only differ in case. Emails are unique
+// ignoring case in both backends, so such data is rejected by the
+// migrations that introduced that rule and by restores
+func checkUniqueEmails(users []User) error {
+	idsByEmail := map[string][]int{}
+	for _, user := range users {
+		key := emailKey(user.Email)
+		idsByEmail[key] = append(idsByEmail[key], user.ID)
+	}
+
+	duplicates := []string{}
+	for email, ids := range idsByEmail {
+		if len(ids) < 2 {
+			continue
+		}
+		sort.Ints(ids)
+		users := make([]string, len(ids))
+		for i, id := range ids {
+			users[i] = strconv.Itoa(id)
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%s (users %s)", email, strings.Join(users, ", ")))
 	}
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
+	if len(duplicates) == 0 {
+		return nil
 	}
 
-	id := len(dbStructure.Users) + 1
-	user := User{
-		ID:             id,
-		Email:          email,
-		HashedPassword: hashedPassword,
-	}
-	dbStructure.Users[id] = user
+	sort.Strings(duplicates)
+	return fmt.Errorf("%w: %s", ErrDuplicateEmails, strings.Join(duplicates, "; "))
+}
 
-	err = db.writeDB(dbStructure)
+// Checks for an existing email, ignoring case, and inserts the User in
+// one DB.Update() transaction, so two signups with the same email can
+// not both succeed
+func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *DBStructure) error {
+		_, err := tx.userByEmail(email)
+		if !errors.Is(err, ErrNotExist) {
+			return ErrAlreadyExists
+		}
+
+		now := tx.now()
+		user = User{
+			ID:             tx.nextUserID(),
+			Email:          email,
+			HashedPassword: hashedPassword,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		return tx.apply(walEntry{Op: opUserCreated, User: &user})
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -41,64 +81,71 @@ func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
 }
 
 func (db *DB) GetUserByID(id int) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(tx *DBStructure) error {
+		dbUser, ok := tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+		user = dbUser
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
-
 	return user, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(tx *DBStructure) error {
+		dbUser, err := tx.userByEmail(email)
+		user = dbUser
+		return err
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if email == user.Email {
-			return user, nil
-		}
-	}
-
-	return User{}, ErrNotExist
+	return user, nil
 }
 
 func (db *DB) GetUsers() ([]User, error) {
-	dbStructure, err := db.loadDB()
+	users := []User{}
+	err := db.View(func(tx *DBStructure) error {
+		users = make([]User, 0, len(tx.Users))
+		for _, user := range tx.Users {
+			users = append(users, user)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	users := make([]User, 0, len(dbStructure.Users))
-	for _, user := range dbStructure.Users {
-		users = append(users, user)
-	}
-
 	return users, nil
 }
 
 func (db *DB) UpdateUser(id int, email, hashedPassword string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
+	user := User{}
+	err := db.Update(func(tx *DBStructure) error {
+		dbUser, ok := tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
 
-	user.Email = email
-	user.HashedPassword = hashedPassword
-	dbStructure.Users[id] = user
+		existing, err := tx.userByEmail(email)
+		if err == nil && existing.ID != id {
+			return ErrAlreadyExists
+		}
 
-	err = db.writeDB(dbStructure)
+		dbUser.Email = email
+		dbUser.HashedPassword = hashedPassword
+		dbUser.UpdatedAt = tx.now()
+		user = dbUser
+		return tx.apply(walEntry{Op: opUserUpdated, User: &user})
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -107,20 +154,17 @@ func (db *DB) UpdateUser(id int, email, hashedPassword string) (User, error) {
 }
 
 func (db *DB) UpgradeChirpyRed(id int) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
-
-	user.IsChirpyRed = true
-	dbStructure.Users[id] = user
+	user := User{}
+	err := db.Update(func(tx *DBStructure) error {
+		_, ok := tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
 
-	err = db.writeDB(dbStructure)
+		err := tx.apply(walEntry{Op: opUserUpgraded, ID: id})
+		user = tx.Users[id]
+		return err
+	})
 	if err != nil {
 		return User{}, err
 	}
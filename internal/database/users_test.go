@@ -0,0 +1,105 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+	jsonDB, err := NewDB(filepath.Join(dir, "database.json"))
+	if err != nil {
+		t.Fatalf("could not open json database: %s", err)
+	}
+	sqliteDB, err := NewSQLiteDB(filepath.Join(dir, "database.sqlite"))
+	if err != nil {
+		t.Fatalf("could not open sqlite database: %s", err)
+	}
+	t.Cleanup(func() {
+		jsonDB.Close()
+		sqliteDB.Close()
+	})
+	return map[string]Store{"json": jsonDB, "sqlite": sqliteDB}
+}
+
+// updating a user leaves their sessions alone, the handler hashes
+// the password anew on every update
+func TestUpdateUserKeepsRefreshTokens(t *testing.T) {
+	for name, db := range openStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@example.com", "old")
+			if err != nil {
+				t.Fatalf("could not create user: %s", err)
+			}
+			err = db.SaveRefreshToken(user.ID, "token")
+			if err != nil {
+				t.Fatalf("could not save token: %s", err)
+			}
+
+			_, err = db.UpdateUser(user.ID, "renamed@example.com", "new")
+			if err != nil {
+				t.Fatalf("could not update user: %s", err)
+			}
+			refreshed, err := db.UserForRefreshToken("token")
+			if err != nil {
+				t.Fatalf("token revoked by the update: %s", err)
+			}
+			if refreshed.Email != "renamed@example.com" {
+				t.Errorf("got email %q for the token, want the new one", refreshed.Email)
+			}
+		})
+	}
+}
+
+// both backends refuse to migrate emails differing only in case
+// and name them in the error
+func TestMigrationsRejectCaseDuplicateEmails(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "database.json")
+	err := os.WriteFile(jsonPath, []byte(`{
+		"schema_version": 8,
+		"users": {
+			"1": {"id": 1, "email": "Dup@example.com"},
+			"2": {"id": 2, "email": "dup@example.com"},
+			"3": {"id": 3, "email": "single@example.com"}
+		}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDB(jsonPath)
+	assertDuplicateEmails(t, "json", err)
+
+	sqlitePath := filepath.Join(dir, "database.sqlite")
+	conn, err := sql.Open("sqlite3", "file:"+sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(sqliteSchema + `
+		PRAGMA user_version = 1;
+		INSERT INTO users (email, hashed_password) VALUES
+			('Dup@example.com', 'hash'), ('dup@example.com', 'hash'), ('single@example.com', 'hash');
+	`)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewSQLiteDB(sqlitePath)
+	assertDuplicateEmails(t, "sqlite", err)
+}
+
+func assertDuplicateEmails(t *testing.T, backend string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrDuplicateEmails) {
+		t.Fatalf("%s: got %v, want ErrDuplicateEmails", backend, err)
+	}
+	if !strings.Contains(err.Error(), "dup@example.com (users 1, 2)") {
+		t.Errorf("%s: error %q does not name the duplicates", backend, err)
+	}
+}
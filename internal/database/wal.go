@@ -0,0 +1,343 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// default WAL size in bytes after which it is compacted into a new snapshot
+const defaultWALCompactSize int64 = 4 << 20
+
+// mutations as recorded in the WAL, one JSON line each
+const (
+	opChirpCreated    = "chirp_created"
+	opChirpTrashed    = "chirp_trashed"
+	opChirpRestored   = "chirp_restored"
+	opChirpDeleted    = "chirp_deleted"
+	opChirpEdited     = "chirp_edited"
+	opUserCreated     = "user_created"
+	opUserUpdated     = "user_updated"
+	opUserUpgraded    = "user_upgraded"
+	opTokenSaved      = "token_saved"
+	opTokenRevoked    = "token_revoked"
+	opFollowed        = "followed"
+	opUnfollowed      = "unfollowed"
+	opReacted         = "reacted"
+	opUnreacted       = "unreacted"
+	opMediaCreated    = "media_created"
+	opMediaDeleted    = "media_deleted"
+	opChirpScheduled  = "chirp_scheduled"
+	opScheduleChanged = "schedule_changed"
+	opScheduleRemoved = "schedule_removed"
+)
+
+// one mutation of the JSON-DB, encrypted on its line like the snapshot
+// when Options.EncryptionKey is set.
+// LSN is the log sequence number, strictly increasing over the
+// lifetime of the DB and persisted in DBStructure.LastLSN
+type walEntry struct {
+	LSN       int64           `json:"lsn"`
+	Time      time.Time       `json:"time"`
+	Op        string          `json:"op"`
+	ID        int             `json:"id,omitempty"`
+	Chirp     *Chirp          `json:"chirp,omitempty"`
+	User      *User           `json:"user,omitempty"`
+	Token     *RefreshToken   `json:"token,omitempty"`
+	Follow    *Follow         `json:"follow,omitempty"`
+	Reaction  *Reaction       `json:"reaction,omitempty"`
+	Revision  *Revision       `json:"revision,omitempty"`
+	Media     *Media          `json:"media,omitempty"`
+	Scheduled *ScheduledChirp `json:"scheduled,omitempty"`
+}
+
+// Records a mutation: applies it to tx and queues it for the WAL.
+// Every change made inside DB.Update() goes through here,
+// otherwise it is lost on restart in WAL mode
+func (tx *DBStructure) apply(entry walEntry) error {
+	entry.LSN = tx.LastLSN + 1
+	entry.Time = tx.now()
+
+	err := tx.replay(entry)
+	if err != nil {
+		return err
+	}
+	tx.pending = append(tx.pending, entry)
+	return nil
+}
+
+// Applies a recorded mutation to tx without queueing it again
+// and adds its event to the journal
+func (tx *DBStructure) replay(entry walEntry) error {
+	switch entry.Op {
+	case opChirpCreated:
+		tx.Chirps[entry.Chirp.ID] = *entry.Chirp
+		tx.Sequences.Chirps = max(tx.Sequences.Chirps, entry.Chirp.ID)
+		tx.idx.addChirp(*entry.Chirp)
+		for _, media := range entry.Chirp.Media {
+			tx.Media[media.ID] = media
+		}
+	case opChirpTrashed:
+		chirp, ok := tx.Chirps[entry.ID]
+		if !ok {
+			return ErrNotExist
+		}
+		deletedAt := entry.Time
+		chirp.DeletedAt = &deletedAt
+		tx.Chirps[entry.ID] = chirp
+	case opChirpRestored:
+		tx.Chirps[entry.Chirp.ID] = *entry.Chirp
+	case opChirpEdited:
+		tx.idx.removeChirp(tx.Chirps[entry.Chirp.ID])
+		tx.Chirps[entry.Chirp.ID] = *entry.Chirp
+		tx.idx.addChirp(*entry.Chirp)
+		tx.Revisions[entry.Chirp.ID] = append(tx.Revisions[entry.Chirp.ID], *entry.Revision)
+	case opChirpDeleted:
+		chirp, ok := tx.Chirps[entry.ID]
+		if ok {
+			delete(tx.Chirps, entry.ID)
+			delete(tx.Likes, entry.ID)
+			delete(tx.Rechirps, entry.ID)
+			delete(tx.Revisions, entry.ID)
+			tx.idx.removeChirp(chirp)
+			for _, media := range chirp.Media {
+				delete(tx.Media, media.ID)
+				delete(tx.idx.mediaByKey, media.Key)
+			}
+		}
+	case opUserCreated, opUserUpdated:
+		previous := tx.Users[entry.User.ID]
+		tx.Users[entry.User.ID] = *entry.User
+		tx.Sequences.Users = max(tx.Sequences.Users, entry.User.ID)
+		tx.idx.putUser(previous, *entry.User)
+	case opUserUpgraded:
+		user, ok := tx.Users[entry.ID]
+		if !ok {
+			return ErrNotExist
+		}
+		user.IsChirpyRed = true
+		user.UpdatedAt = entry.Time
+		tx.Users[entry.ID] = user
+	case opTokenSaved:
+		tx.RefreshTokens[entry.Token.Token] = *entry.Token
+		tx.idx.addToken(*entry.Token)
+	case opTokenRevoked:
+		refreshToken, ok := tx.RefreshTokens[entry.Token.Token]
+		if ok {
+			delete(tx.RefreshTokens, entry.Token.Token)
+			tx.idx.removeToken(refreshToken)
+		}
+	case opFollowed:
+		follow := entry.Follow
+		if tx.Follows[follow.FollowerID] == nil {
+			tx.Follows[follow.FollowerID] = map[int]time.Time{}
+		}
+		tx.Follows[follow.FollowerID][follow.FolloweeID] = follow.CreatedAt
+		tx.idx.addFollow(*follow)
+	case opUnfollowed:
+		follow := entry.Follow
+		delete(tx.Follows[follow.FollowerID], follow.FolloweeID)
+		if len(tx.Follows[follow.FollowerID]) == 0 {
+			delete(tx.Follows, follow.FollowerID)
+		}
+		tx.idx.removeFollow(*follow)
+	case opReacted:
+		reaction := entry.Reaction
+		reactions := tx.reactions(reaction.Kind)
+		if reactions == nil {
+			return ErrUnknownReaction
+		}
+		if reactions[reaction.ChirpID] == nil {
+			reactions[reaction.ChirpID] = map[int]time.Time{}
+		}
+		reactions[reaction.ChirpID][reaction.UserID] = reaction.CreatedAt
+	case opUnreacted:
+		reaction := entry.Reaction
+		reactions := tx.reactions(reaction.Kind)
+		if reactions == nil {
+			return ErrUnknownReaction
+		}
+		delete(reactions[reaction.ChirpID], reaction.UserID)
+		if len(reactions[reaction.ChirpID]) == 0 {
+			delete(reactions, reaction.ChirpID)
+		}
+	case opMediaCreated:
+		tx.Media[entry.Media.ID] = *entry.Media
+		tx.Sequences.Media = max(tx.Sequences.Media, entry.Media.ID)
+		tx.idx.mediaByKey[entry.Media.Key] = entry.Media.ID
+	case opMediaDeleted:
+		media, ok := tx.Media[entry.ID]
+		if ok {
+			delete(tx.Media, entry.ID)
+			delete(tx.idx.mediaByKey, media.Key)
+		}
+	case opChirpScheduled, opScheduleChanged:
+		tx.idx.removeScheduled(tx.Scheduled[entry.Scheduled.ID])
+		tx.Scheduled[entry.Scheduled.ID] = *entry.Scheduled
+		tx.Sequences.Scheduled = max(tx.Sequences.Scheduled, entry.Scheduled.ID)
+		tx.idx.addScheduled(*entry.Scheduled)
+	case opScheduleRemoved:
+		scheduled, ok := tx.Scheduled[entry.ID]
+		if ok {
+			delete(tx.Scheduled, entry.ID)
+			tx.idx.removeScheduled(scheduled)
+		}
+	default:
+		return fmt.Errorf("unknown wal op %q", entry.Op)
+	}
+
+	tx.LastLSN = entry.LSN
+	tx.journal(entry)
+	return nil
+}
+
+// path of the WAL next to the snapshot
+func (db *DB) walPath() string {
+	return db.path + ".wal"
+}
+
+// Replays the WAL on top of the cached snapshot and opens it for appending.
+// Entries already contained in the snapshot (LSN <= LastLSN) are skipped.
+// A torn last line from a crash mid-append is dropped.
+// Callers must hold db.mu for writing
+func (db *DB) openWAL() error {
+	perm := os.FileMode(syscall.S_IRUSR | syscall.S_IWUSR)
+	file, err := os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+
+	replayed, err := db.replayWAL(db.cache, file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	db.wal = file
+	if replayed > 0 {
+		log.Printf("replayed %d entries from %s", replayed, db.walPath())
+	}
+	// start from a clean log, so a torn line never ends up in the middle
+	return db.compactLocked()
+}
+
+// Replays the entries read from r on top of tx, skipping those
+// the snapshot already contains and dropping a torn last line.
+// Returns how many entries were replayed
+func (db *DB) replayWAL(tx *DBStructure, r io.Reader) (int, error) {
+	replayed := 0
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("dropping torn entry at end of %s", db.walPath())
+			}
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		line, _, err = db.keys.open(bytes.TrimSpace(line))
+		if err != nil {
+			return replayed, err
+		}
+
+		entry := walEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return replayed, fmt.Errorf("corrupt wal entry in %s: %w", db.walPath(), err)
+		}
+		if entry.LSN <= tx.LastLSN {
+			continue
+		}
+		err = tx.replay(entry)
+		if err != nil {
+			return replayed, fmt.Errorf("could not replay wal entry %d: %w", entry.LSN, err)
+		}
+		replayed++
+	}
+}
+
+// Appends entries to the WAL and fsyncs it. Compacts the WAL into a new
+// snapshot once it grew past Options.WALCompactSize.
+// A failed write cuts the log back to its previous size, so the entries
+// are never replayed. A failed compaction is only logged, the entries
+// are durable in the log by then and the next append retries it.
+// Callers must hold db.mu for writing
+func (db *DB) appendWAL(entries []walEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	data := []byte{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line, err = db.keys.encode(line)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	_, err := db.wal.Write(data)
+	if err == nil {
+		err = db.wal.Sync()
+	}
+	if err != nil {
+		truncErr := db.wal.Truncate(db.walSize)
+		if truncErr == nil {
+			_, truncErr = db.wal.Seek(db.walSize, io.SeekStart)
+		}
+		return errors.Join(err, truncErr)
+	}
+	db.walSize += int64(len(data))
+
+	compactSize := db.opts.WALCompactSize
+	if compactSize <= 0 {
+		compactSize = defaultWALCompactSize
+	}
+	if db.walSize < compactSize {
+		return nil
+	}
+	err = db.compactLocked()
+	if err != nil {
+		log.Printf("could not compact %s, retrying with the next write: %s", db.walPath(), err)
+	}
+	return nil
+}
+
+// Writes the cache as new snapshot and empties the WAL.
+// The snapshot carries LastLSN, so a crash between both steps
+// only leaves entries behind that the next replay skips.
+// Callers must hold db.mu for writing
+func (db *DB) compactLocked() error {
+	err := db.writeDB(*db.cache)
+	if err != nil {
+		return err
+	}
+	db.dirty = false
+
+	err = db.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = db.wal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	db.walSize = 0
+	return db.wal.Sync()
+}
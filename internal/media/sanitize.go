@@ -0,0 +1,283 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"net/http"
+
+	// registers the decoders image.DecodeConfig checks uploads with
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+var ErrUnsupportedType = errors.New("unsupported media type, expected jpeg, png or gif")
+var ErrCorruptImage = errors.New("could not read image")
+
+// content types accepted for uploads, with the extension their keys get
+var Extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// the image.DecodeConfig format name of each accepted content type
+var formats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// Tells the content type of an upload from its bytes, never from what
+// the client claims, checks that it really is an image of that type and
+// strips the metadata it carries: EXIF with camera details and GPS
+// position, XMP, IPTC and comments. The pixels are left untouched,
+// nothing is re-encoded. Bytes trailing the end of the image are dropped
+func Sanitize(data []byte) (string, []byte, error) {
+	contentType := http.DetectContentType(data)
+	format, ok := formats[contentType]
+	if !ok {
+		return "", nil, ErrUnsupportedType
+	}
+
+	_, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return "", nil, ErrCorruptImage
+	}
+
+	switch contentType {
+	case "image/jpeg":
+		data, err = stripJPEG(data)
+	case "image/png":
+		data, err = stripPNG(data)
+	case "image/gif":
+		data, err = stripGIF(data)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
+
+// JPEG segments dropped by stripJPEG: APP1 holds EXIF and XMP,
+// APP13 IPTC, COM free text. JFIF (APP0), the color profile (APP2)
+// and the Adobe color transform (APP14) are kept, they affect rendering
+var strippedJPEGMarkers = map[byte]bool{
+	0xE1: true,
+	0xED: true,
+	0xFE: true,
+}
+
+// Copies the segments of a JPEG up to the end of image, leaving out
+// strippedJPEGMarkers. The entropy-coded data following each start of
+// scan is copied as is. Anything trailing the end of image is dropped
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrCorruptImage
+	}
+
+	clean := []byte{0xFF, 0xD8}
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, ErrCorruptImage
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// fill byte before a marker
+			i++
+			continue
+		case marker == 0xD9:
+			// end of image
+			return append(clean, 0xFF, 0xD9), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// markers without a length
+			clean = append(clean, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, ErrCorruptImage
+		}
+		// the length counts itself, but not the marker
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrCorruptImage
+		}
+		if !strippedJPEGMarkers[marker] {
+			clean = append(clean, data[i:end]...)
+		}
+		i = end
+
+		if marker == 0xDA {
+			// start of scan, its image data runs up to the next marker
+			scanEnd, err := jpegScanEnd(data, i)
+			if err != nil {
+				return nil, err
+			}
+			clean = append(clean, data[i:scanEnd]...)
+			i = scanEnd
+		}
+	}
+}
+
+// Finds the marker ending the entropy-coded data starting at i.
+// Inside it 0xFF is followed by a stuffed 0x00 or a restart marker
+func jpegScanEnd(data []byte, i int) (int, error) {
+	for ; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			i++
+			continue
+		}
+		return i, nil
+	}
+	return 0, ErrCorruptImage
+}
+
+// PNG chunks dropped by stripPNG: EXIF, the three kinds of text chunks,
+// which also carry XMP, and the last modification time
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Copies the chunks of a PNG up to IEND, leaving out strippedPNGChunks.
+// Anything trailing IEND is dropped as well
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrCorruptImage
+	}
+
+	clean := append([]byte{}, pngSignature...)
+	i := len(pngSignature)
+	for {
+		// length, type, data and CRC
+		if i+12 > len(data) {
+			return nil, ErrCorruptImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrCorruptImage
+		}
+		chunkType := string(data[i+4 : i+8])
+		if !strippedPNGChunks[chunkType] {
+			clean = append(clean, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return clean, nil
+		}
+		i = end
+	}
+}
+
+// the application extension GIFs may keep, it holds the loop count of
+// animations. Others, like XMP, are dropped by stripGIF, as are comments
+const gifLoopExtension = "NETSCAPE2.0"
+
+// Copies the blocks of a GIF up to the trailer, leaving out comments
+// and application extensions other than gifLoopExtension.
+// Anything trailing the trailer is dropped
+func stripGIF(data []byte) ([]byte, error) {
+	// header and logical screen descriptor
+	if len(data) < 13 {
+		return nil, ErrCorruptImage
+	}
+	i := 13 + gifColorTableSize(data[10])
+	if i > len(data) {
+		return nil, ErrCorruptImage
+	}
+
+	clean := append([]byte{}, data[:i]...)
+	for {
+		if i >= len(data) {
+			return nil, ErrCorruptImage
+		}
+		switch data[i] {
+		case 0x3B:
+			// trailer
+			return append(clean, 0x3B), nil
+		case 0x21:
+			// extension: introducer, label, then data sub-blocks
+			if i+2 > len(data) {
+				return nil, ErrCorruptImage
+			}
+			end, err := gifSubBlocksEnd(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			if keepGIFExtension(data[i+1], data[i+2:end]) {
+				clean = append(clean, data[i:end]...)
+			}
+			i = end
+		case 0x2C:
+			// image descriptor, local color table, LZW code size, image data
+			if i+10 > len(data) {
+				return nil, ErrCorruptImage
+			}
+			blocks := i + 10 + gifColorTableSize(data[i+9]) + 1
+			if blocks > len(data) {
+				return nil, ErrCorruptImage
+			}
+			end, err := gifSubBlocksEnd(data, blocks)
+			if err != nil {
+				return nil, err
+			}
+			clean = append(clean, data[i:end]...)
+			i = end
+		default:
+			return nil, ErrCorruptImage
+		}
+	}
+}
+
+// size in bytes of the color table announced by the packed fields
+// of a logical screen or image descriptor
+func gifColorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (packed&0x07 + 1)
+}
+
+// Finds the end of the data sub-blocks starting at i,
+// just past their terminating empty block
+func gifSubBlocksEnd(data []byte, i int) (int, error) {
+	for i < len(data) {
+		size := int(data[i])
+		i += 1 + size
+		if size == 0 {
+			return i, nil
+		}
+	}
+	return 0, ErrCorruptImage
+}
+
+// Tells if an extension with the given label and sub-blocks is kept.
+// Comments (0xFE) are dropped, application extensions (0xFF) unless
+// they are the loop count, all others affect rendering
+func keepGIFExtension(label byte, blocks []byte) bool {
+	switch label {
+	case 0xFE:
+		return false
+	case 0xFF:
+		// the first sub-block holds the identifier and authentication code
+		return len(blocks) >= 12 && blocks[0] == 11 && string(blocks[1:12]) == gifLoopExtension
+	default:
+		return true
+	}
+}
@@ -0,0 +1,114 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+// hidden behind the end of an image, survives unless the sanitizer stops there
+var trailingPayload = []byte("<?php system($_GET['cmd']); ?>")
+
+func TestSanitizeJPEG(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := range 16 {
+		img.Set(x, x, color.RGBA{R: 255, A: 255})
+	}
+	encoded := &bytes.Buffer{}
+	err := jpeg.Encode(encoded, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an EXIF segment right after the start of image, a payload after its end
+	exif := append([]byte{0xFF, 0xE1, 0x00, 0x0E}, []byte("Exif\x00\x00secret")...)
+	data := append([]byte{0xFF, 0xD8}, exif...)
+	data = append(data, encoded.Bytes()[2:]...)
+	data = append(data, trailingPayload...)
+
+	contentType, clean, err := Sanitize(data)
+	if err != nil {
+		t.Fatalf("could not sanitize: %s", err)
+	}
+	if contentType != "image/jpeg" {
+		t.Errorf("got content type %s, want image/jpeg", contentType)
+	}
+	if !bytes.Equal(clean, encoded.Bytes()) {
+		t.Errorf("got %d bytes, want the %d bytes of the plain image", len(clean), encoded.Len())
+	}
+	_, err = jpeg.Decode(bytes.NewReader(clean))
+	if err != nil {
+		t.Errorf("sanitized image does not decode: %s", err)
+	}
+}
+
+func TestSanitizeGIF(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+		image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+	}
+	encoded := &bytes.Buffer{}
+	err := gif.EncodeAll(encoded, &gif.GIF{Image: frames, Delay: []int{10, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(encoded.Bytes(), []byte(gifLoopExtension)) {
+		t.Fatal("encoded animation has no loop extension")
+	}
+
+	// XMP and a comment before the trailer, a payload after it
+	xmp := append([]byte{0x21, 0xFF, 11}, []byte("XMP DataXMP")...)
+	xmp = append(xmp, 6, 's', 'e', 'c', 'r', 'e', 't', 0)
+	comment := []byte{0x21, 0xFE, 6, 's', 'e', 'c', 'r', 'e', 't', 0}
+	plain := encoded.Bytes()
+	data := append([]byte{}, plain[:len(plain)-1]...)
+	data = append(data, xmp...)
+	data = append(data, comment...)
+	data = append(data, 0x3B)
+	data = append(data, trailingPayload...)
+
+	contentType, clean, err := Sanitize(data)
+	if err != nil {
+		t.Fatalf("could not sanitize: %s", err)
+	}
+	if contentType != "image/gif" {
+		t.Errorf("got content type %s, want image/gif", contentType)
+	}
+	if !bytes.Equal(clean, plain) {
+		t.Errorf("got %d bytes, want the %d bytes of the plain animation", len(clean), len(plain))
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatalf("sanitized animation does not decode: %s", err)
+	}
+	if len(decoded.Image) != len(frames) {
+		t.Errorf("got %d frames, want %d", len(decoded.Image), len(frames))
+	}
+}
+
+// cut off images have no end to stop at
+func TestSanitizeRejectsTruncated(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	err := jpeg.Encode(encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stripJPEG(encoded.Bytes()[:encoded.Len()-2])
+	if err != ErrCorruptImage {
+		t.Errorf("got %v for a JPEG without end of image, want ErrCorruptImage", err)
+	}
+
+	encoded.Reset()
+	err = gif.Encode(encoded, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stripGIF(encoded.Bytes()[:encoded.Len()-1])
+	if err != ErrCorruptImage {
+		t.Errorf("got %v for a GIF without trailer, want ErrCorruptImage", err)
+	}
+}
@@ -0,0 +1,174 @@
+package media
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrBlobNotExist = errors.New("blob does not exist")
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// BlobStore keeps the bytes of uploads, addressed by key.
+// Which uploads exist is tracked by the database, so a store only has
+// to hold bytes and list what it holds for the orphan collector.
+// LocalStore is the default, other backends can be plugged in
+// without touching the handlers
+type BlobStore interface {
+	// stores the bytes of r under key, replacing nothing:
+	// keys are random and never reused
+	Put(key string, r io.Reader) error
+	// opens the bytes under key, ErrBlobNotExist if there are none
+	Open(key string) (Blob, error)
+	// removes the bytes under key, a missing key is not an error
+	Delete(key string) error
+	// lists every stored blob
+	List() ([]BlobInfo, error)
+}
+
+// stored bytes as handed out by BlobStore.Open(),
+// seekable so they can be served with range requests
+type Blob interface {
+	io.ReadSeekCloser
+	ModTime() time.Time
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// keeps blobs as files in one directory on the local filesystem
+type LocalStore struct {
+	dir string
+}
+
+// opens the LocalStore in dir, creating the directory if needed
+func NewLocalStore(dir string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// keys become file names, so they may not leave the directory
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || key != filepath.Base(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Writes to a temp file first and renames it into place once synced,
+// so a crash never leaves a partial blob under key
+func (s *LocalStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *LocalStore) Open(key string) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return localBlob{File: file, modTime: info.ModTime()}, nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Lists the blobs in the directory. Temp files of Put() are listed too,
+// so uploads that crashed halfway get collected like any other orphan
+func (s *LocalStore) List() ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []BlobInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, BlobInfo{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return blobs, nil
+}
+
+type localBlob struct {
+	*os.File
+	modTime time.Time
+}
+
+func (b localBlob) ModTime() time.Time {
+	return b.modTime
+}
+
+// a new random key for an upload of contentType,
+// ending in the extension of its type
+func NewKey(contentType string) (string, error) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key) + Extensions[contentType], nil
+}
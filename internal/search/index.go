@@ -0,0 +1,254 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Katalcha/go-chirpy/internal/changefeed"
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// in-memory inverted index over chirp bodies.
+// It is derived data, rebuilt from the database on start
+// and kept current by Sync()
+type Index struct {
+	mu *sync.RWMutex
+	// chirp ID -> indexed chirp
+	docs map[int]document
+	// term -> chirp ID -> positions of the term in the body
+	postings map[string]map[int][]int
+	// follows the change feed for Sync()
+	feed *changefeed.Follower
+}
+
+type document struct {
+	chirp  database.Chirp
+	length int
+}
+
+// a chirp matching a query, with its relevance
+type Result struct {
+	Chirp database.Chirp
+	Score float64
+}
+
+func NewIndex() *Index {
+	idx := &Index{
+		mu:       &sync.RWMutex{},
+		docs:     map[int]document{},
+		postings: map[string]map[int][]int{},
+	}
+	idx.feed = changefeed.NewFollower("search index", idx.Reset, idx.apply)
+	return idx
+}
+
+// Splits text into lowercased terms at everything that is not a letter
+// or digit. Lowercasing is the same strings.ToLower as in
+// utils.ReplaceBadWords, and censored words ("****") leave no term
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, field := range fields {
+		fields[i] = strings.ToLower(field)
+	}
+	return fields
+}
+
+// indexes chirp, replacing an earlier version of it
+func (idx *Index) Add(chirp database.Chirp) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(chirp.ID)
+	idx.addLocked(chirp)
+}
+
+// drops the chirp with id from the index, if present
+func (idx *Index) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+}
+
+// replaces the whole index with chirps
+func (idx *Index) Reset(chirps []database.Chirp) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.docs = map[int]document{}
+	idx.postings = map[string]map[int][]int{}
+	for _, chirp := range chirps {
+		idx.addLocked(chirp)
+	}
+}
+
+// number of indexed chirps
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.docs)
+}
+
+func (idx *Index) addLocked(chirp database.Chirp) {
+	terms := Tokenize(chirp.Body)
+	idx.docs[chirp.ID] = document{chirp: chirp, length: len(terms)}
+	for position, term := range terms {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+		}
+		docs[chirp.ID] = append(docs[chirp.ID], position)
+	}
+}
+
+func (idx *Index) removeLocked(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+
+	delete(idx.docs, id)
+	for _, term := range Tokenize(doc.chirp.Body) {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+// Finds the chirps matching every clause of query, best match first.
+// authorID > 0 only searches chirps of that author,
+// limit > 0 caps the number of results
+func (idx *Index) Search(query Query, authorID int, limit int) []Result {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	scores := map[int]float64{}
+	for i, clause := range query.clauses {
+		clauseScores := idx.scoreClause(clause)
+
+		// every clause has to match, so only the first one adds candidates
+		if i == 0 {
+			scores = clauseScores
+			continue
+		}
+		for id, score := range scores {
+			clauseScore, ok := clauseScores[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] = score + clauseScore
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		doc := idx.docs[id]
+		if authorID > 0 && doc.chirp.AuthorID != authorID {
+			continue
+		}
+		// longer chirps match more by chance, damp them a little
+		results = append(results, Result{
+			Chirp: doc.chirp,
+			Score: score / math.Sqrt(float64(max(doc.length, 1))),
+		})
+	}
+
+	// best score first, newer chirps win ties
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if !results[i].Chirp.CreatedAt.Equal(results[j].Chirp.CreatedAt) {
+			return results[i].Chirp.CreatedAt.After(results[j].Chirp.CreatedAt)
+		}
+		return results[i].Chirp.ID > results[j].Chirp.ID
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// scores every chirp matching clause by tf-idf.
+// Callers must hold idx.mu for reading
+func (idx *Index) scoreClause(c clause) map[int]float64 {
+	scores := map[int]float64{}
+
+	switch {
+	case c.prefix:
+		for term, docs := range idx.postings {
+			if !strings.HasPrefix(term, c.terms[0]) {
+				continue
+			}
+			idf := idx.idf(len(docs))
+			for id, positions := range docs {
+				scores[id] += tf(len(positions)) * idf
+			}
+		}
+	case len(c.terms) == 1:
+		docs := idx.postings[c.terms[0]]
+		idf := idx.idf(len(docs))
+		for id, positions := range docs {
+			scores[id] = tf(len(positions)) * idf
+		}
+	default:
+		idf := 0.0
+		for _, term := range c.terms {
+			idf += idx.idf(len(idx.postings[term]))
+		}
+		for id := range idx.postings[c.terms[0]] {
+			n := idx.phraseMatches(id, c.terms)
+			if n > 0 {
+				scores[id] = tf(n) * idf
+			}
+		}
+	}
+	return scores
+}
+
+// counts how often terms occur back to back in the chirp with id.
+// Callers must hold idx.mu for reading
+func (idx *Index) phraseMatches(id int, terms []string) int {
+	matches := 0
+	for _, start := range idx.postings[terms[0]][id] {
+		found := true
+		for offset, term := range terms[1:] {
+			if !containsPosition(idx.postings[term][id], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			matches++
+		}
+	}
+	return matches
+}
+
+// positions are appended in order, so they are sorted
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
+
+// rare terms weigh more than common ones.
+// Callers must hold idx.mu for reading
+func (idx *Index) idf(docFrequency int) float64 {
+	return math.Log(1 + float64(len(idx.docs))/float64(max(docFrequency, 1)))
+}
+
+// repeated terms count, but with diminishing returns
+func tf(frequency int) float64 {
+	return 1 + math.Log(float64(frequency))
+}
@@ -0,0 +1,63 @@
+package search
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrEmptyQuery = errors.New("query has no searchable terms")
+
+/*
+	QUERY SYNTAX:
+	chirpy kerfuffle	every word has to occur
+	"fornax rising"		words in quotes have to occur in this order
+	chir*				words starting with chir
+*/
+
+// a parsed search query, matching chirps that match all of its clauses
+type Query struct {
+	clauses []clause
+}
+
+// one word, phrase or prefix of a Query
+type clause struct {
+	terms  []string
+	prefix bool
+}
+
+// Parses the query syntax above. Words are tokenized like chirp bodies,
+// so a word like "re-chirp" turns into the phrase "re chirp"
+func ParseQuery(q string) (Query, error) {
+	query := Query{}
+
+	parts := strings.Split(q, `"`)
+	for i, part := range parts {
+		// odd parts sit between quotes; an unclosed quote runs to the end
+		if i%2 == 1 {
+			query.add(Tokenize(part), false)
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			query.add(Tokenize(strings.TrimRight(word, "*")), prefix)
+		}
+	}
+
+	if len(query.clauses) == 0 {
+		return Query{}, ErrEmptyQuery
+	}
+	return query, nil
+}
+
+func (query *Query) add(terms []string, prefix bool) {
+	if len(terms) == 0 {
+		return
+	}
+	if prefix && len(terms) > 1 {
+		// only the last term of a word like "re-ch*" is a prefix
+		query.clauses = append(query.clauses, clause{terms: terms[:len(terms)-1]})
+		terms = terms[len(terms)-1:]
+	}
+	query.clauses = append(query.clauses, clause{terms: terms, prefix: prefix})
+}
@@ -0,0 +1,28 @@
+package search
+
+import (
+	"context"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// Keeps idx in sync with store until ctx is done,
+// see changefeed.Follower.Sync()
+func (idx *Index) Sync(ctx context.Context, store database.Store) error {
+	return idx.feed.Sync(ctx, store)
+}
+
+// Asks Sync() to rebuild the index, for changes that bypass
+// the change feed like database.Store.Restore()
+func (idx *Index) Resync() {
+	idx.feed.Resync()
+}
+
+func (idx *Index) apply(event database.Event) {
+	switch event.Type {
+	case database.EventChirpCreated, database.EventChirpRestored, database.EventChirpEdited:
+		idx.Add(*event.Chirp)
+	case database.EventChirpDeleted, database.EventChirpPurged:
+		idx.Remove(event.ID)
+	}
+}
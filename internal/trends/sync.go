@@ -0,0 +1,28 @@
+package trends
+
+import (
+	"context"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// Keeps t in sync with store until ctx is done,
+// see changefeed.Follower.Sync()
+func (t *Tracker) Sync(ctx context.Context, store database.Store) error {
+	return t.feed.Sync(ctx, store)
+}
+
+// Asks Sync() to rebuild the counts, for changes that bypass
+// the change feed like database.Store.Restore()
+func (t *Tracker) Resync() {
+	t.feed.Resync()
+}
+
+func (t *Tracker) apply(event database.Event) {
+	switch event.Type {
+	case database.EventChirpCreated, database.EventChirpRestored, database.EventChirpEdited:
+		t.Add(*event.Chirp)
+	case database.EventChirpDeleted, database.EventChirpPurged:
+		t.Remove(event.ID)
+	}
+}
@@ -0,0 +1,206 @@
+package trends
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/changefeed"
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// the longest window trends can be asked for,
+// older hashtag uses are dropped
+const MaxWindow = 24 * time.Hour
+
+// uses are counted per bucket, the resolution of the sliding windows
+const bucketSize = time.Minute
+
+// a hashtag in use within a window. Count is the number of visible chirps
+// using it, Score the same count with every use decaying by half each
+// quarter of the window, so recent bursts rank above steady old ones
+type Trend struct {
+	Tag   string  `json:"tag"`
+	Count int     `json:"count"`
+	Score float64 `json:"score"`
+}
+
+// in-memory hashtag counts over sliding windows up to MaxWindow.
+// It is derived data, rebuilt from the database on start
+// and kept current by Sync(). Uses are dated by Chirp.CreatedAt,
+// so a rebuild gives the same trends as the live counts
+type Tracker struct {
+	mu *sync.Mutex
+	// chirp ID -> its counted hashtags, to take them back on delete or edit
+	chirps map[int]usage
+	// TagKey() of a hashtag -> bucket -> number of uses
+	buckets map[string]map[int64]int
+	// start of the last bucket prune
+	pruned time.Time
+	// follows the change feed for Sync()
+	feed *changefeed.Follower
+}
+
+type usage struct {
+	tags   []string
+	bucket int64
+}
+
+func NewTracker() *Tracker {
+	t := &Tracker{
+		mu:      &sync.Mutex{},
+		chirps:  map[int]usage{},
+		buckets: map[string]map[int64]int{},
+	}
+	t.feed = changefeed.NewFollower("trends", t.Reset, t.apply)
+	return t
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.Unix() / int64(bucketSize/time.Second)
+}
+
+func bucketStart(bucket int64) time.Time {
+	return time.Unix(bucket*int64(bucketSize/time.Second), 0)
+}
+
+// the distinct hashtags of chirp, a chirp counts once per tag
+func tagsOf(chirp database.Chirp) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, entity := range chirp.Entities {
+		if entity.Type == database.EntityHashtag && !seen[entity.Tag] {
+			seen[entity.Tag] = true
+			tags = append(tags, entity.Tag)
+		}
+	}
+	return tags
+}
+
+// counts the hashtags of chirp, replacing an earlier version of it
+func (t *Tracker) Add(chirp database.Chirp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(chirp.ID)
+	t.addLocked(chirp, time.Now())
+}
+
+// takes back the hashtags of a chirp, if they were counted
+func (t *Tracker) Remove(id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(id)
+}
+
+// replaces all counts with the hashtags of chirps
+func (t *Tracker) Reset(chirps []database.Chirp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.chirps = map[int]usage{}
+	t.buckets = map[string]map[int64]int{}
+	t.pruned = now
+	for _, chirp := range chirps {
+		t.addLocked(chirp, now)
+	}
+}
+
+func (t *Tracker) addLocked(chirp database.Chirp, now time.Time) {
+	if chirp.IsDeleted() || chirp.CreatedAt.Before(now.Add(-MaxWindow)) {
+		return
+	}
+	tags := tagsOf(chirp)
+	if len(tags) == 0 {
+		return
+	}
+
+	u := usage{tags: tags, bucket: bucketOf(chirp.CreatedAt)}
+	t.chirps[chirp.ID] = u
+	for _, tag := range u.tags {
+		buckets, ok := t.buckets[tag]
+		if !ok {
+			buckets = map[int64]int{}
+			t.buckets[tag] = buckets
+		}
+		buckets[u.bucket]++
+	}
+}
+
+func (t *Tracker) removeLocked(id int) {
+	u, ok := t.chirps[id]
+	if !ok {
+		return
+	}
+
+	delete(t.chirps, id)
+	for _, tag := range u.tags {
+		buckets := t.buckets[tag]
+		buckets[u.bucket]--
+		if buckets[u.bucket] <= 0 {
+			delete(buckets, u.bucket)
+		}
+		if len(buckets) == 0 {
+			delete(t.buckets, tag)
+		}
+	}
+}
+
+// drops the uses that fell out of MaxWindow, at most once per bucket
+func (t *Tracker) pruneLocked(now time.Time) {
+	if now.Sub(t.pruned) < bucketSize {
+		return
+	}
+	t.pruned = now
+
+	cutoff := bucketOf(now.Add(-MaxWindow))
+	for id, u := range t.chirps {
+		if u.bucket < cutoff {
+			t.removeLocked(id)
+		}
+	}
+}
+
+// The hashtags used within the last window, highest Score first.
+// window is capped at MaxWindow, limit > 0 caps the number of trends
+func (t *Tracker) Top(window time.Duration, limit int) []Trend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.pruneLocked(now)
+
+	window = min(window, MaxWindow)
+	first := bucketOf(now.Add(-window))
+	halfLife := window / 4
+
+	trends := []Trend{}
+	for tag, buckets := range t.buckets {
+		trend := Trend{Tag: tag}
+		for bucket, uses := range buckets {
+			if bucket < first {
+				continue
+			}
+			age := now.Sub(bucketStart(bucket))
+			trend.Count += uses
+			trend.Score += float64(uses) * math.Exp2(-float64(age)/float64(halfLife))
+		}
+		if trend.Count > 0 {
+			trends = append(trends, trend)
+		}
+	}
+
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Score != trends[j].Score {
+			return trends[i].Score > trends[j].Score
+		}
+		return trends[i].Tag < trends[j].Tag
+	})
+	if limit > 0 && len(trends) > limit {
+		trends = trends[:limit]
+	}
+	return trends
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/media"
+	"github.com/Katalcha/go-chirpy/internal/search"
+	"github.com/Katalcha/go-chirpy/internal/trends"
 	"github.com/joho/godotenv"
 )
 
@@ -14,22 +26,68 @@ import (
 const (
 	LOCALHOST          string = "localhost"
 	PORT               string = "8080"
-	FILE_ROOT_PATH     string = "."
+	FILE_ROOT_PATH     string = "static"
 	FILE_DATABASE_PATH string = "database.json"
+	FILE_SQLITE_PATH   string = "database.sqlite"
+	FILE_MEDIA_PATH    string = "media"
+
+	SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
+
+	// how long deleted chirps stay restorable before they are purged
+	TRASH_RETENTION time.Duration = 30 * 24 * time.Hour
+
+	// how long after creating a chirp its author can still edit it
+	EDIT_WINDOW time.Duration = time.Hour
+
+	// how long uploads may wait to be attached to a chirp before they are collected
+	MEDIA_ORPHAN_TTL time.Duration = 24 * time.Hour
+)
+
+// DATABASE BACKENDS
+const (
+	BACKEND_JSON   string = "json"
+	BACKEND_SQLITE string = "sqlite"
+)
+
+// BLOB STORES
+const (
+	BLOB_STORE_LOCAL string = "local"
 )
 
 // ENDPOINTS
 const (
-	FILE_SERVER_PATH string = "/app/*"
+	FILE_SERVER_PATH string = "/app/"
+	MEDIA_FILES      string = "/media/{key}"
 
 	API_HEALTHZ string = "/api/healthz"
 
-	API_CHIRPS         string = "/api/chirps"
-	API_CHIRPS_ID      string = "/api/chirps/{chirpID}"
-	API_VALIDATE_CHIRP string = "/api/validate_chirp"
+	API_CHIRPS           string = "/api/chirps"
+	API_CHIRPS_ID        string = "/api/chirps/{chirpID}"
+	API_CHIRPS_TRASH     string = "/api/chirps/trash"
+	API_CHIRPS_SEARCH    string = "/api/chirps/search"
+	API_CHIRPS_RESTORE   string = "/api/chirps/{chirpID}/restore"
+	API_CHIRPS_THREAD    string = "/api/chirps/{chirpID}/thread"
+	API_CHIRPS_REVISIONS string = "/api/chirps/{chirpID}/revisions"
+	API_CHIRPS_LIKE      string = "/api/chirps/{chirpID}/like"
+	API_CHIRPS_RECHIRP   string = "/api/chirps/{chirpID}/rechirp"
+
+	API_SCHEDULED_CHIRPS    string = "/api/scheduled_chirps"
+	API_SCHEDULED_CHIRPS_ID string = "/api/scheduled_chirps/{scheduledID}"
+	API_VALIDATE_CHIRP      string = "/api/validate_chirp"
+
+	API_USERS           string = "/api/users"
+	API_USERS_ID        string = "/api/users/{userID}"
+	API_USERS_FOLLOW    string = "/api/users/{userID}/follow"
+	API_USERS_FOLLOWERS string = "/api/users/{userID}/followers"
+	API_USERS_FOLLOWING string = "/api/users/{userID}/following"
+	API_USERS_MENTIONS  string = "/api/users/{userID}/mentions"
 
-	API_USERS    string = "/api/users"
-	API_USERS_ID string = "/api/users/{userID}"
+	API_TAGS_CHIRPS string = "/api/tags/{tag}/chirps"
+	API_TRENDS      string = "/api/trends"
+
+	API_MEDIA string = "/api/media"
+
+	API_TIMELINE string = "/api/timeline"
 
 	API_LOGIN   string = "/api/login"
 	API_REFRESH string = "/api/refresh"
@@ -39,6 +97,8 @@ const (
 
 	ADMIN_METRICS       string = "/admin/metrics"
 	ADMIN_METRICS_RESET string = "/admin/reset"
+	ADMIN_BACKUP        string = "/admin/backup"
+	ADMIN_RESTORE       string = "/admin/restore"
 )
 
 // HTTP METHODS
@@ -51,14 +111,41 @@ const (
 
 // intern config struct to hold state
 // fileServerHits - tracks the visitor count
+// reapedTokens - counts expired refresh tokens purged by the sweeper
+// purgedChirps - counts deleted chirps purged after trashRetention
+// collectedMedia - counts orphaned uploads removed by the media collector
+// publishedChirps - counts scheduled chirps published by the scheduler
+// editWindow - how long chirps can be edited after creation, 0 for no limit
+// searchIndex - full-text index over chirp bodies, kept in sync by a worker
+// trends - hashtag counts over sliding windows, kept in sync by a worker
+// blobs - where the bytes of uploads are kept
+// mediaOrphanTTL - how long uploads may stay unattached
+// schedulerWake - wakes the scheduler when scheduled chirps change
 type apiConfig struct {
-	fileServerHits int
-	DB             *database.DB
-	jwtSecret      string
-	polkaKey       string
+	fileServerHits  int
+	reapedTokens    atomic.Int64
+	purgedChirps    atomic.Int64
+	collectedMedia  atomic.Int64
+	publishedChirps atomic.Int64
+	DB              database.Store
+	jwtSecret       string
+	polkaKey        string
+	adminKey        string
+	trashRetention  time.Duration
+	editWindow      time.Duration
+	searchIndex     *search.Index
+	trends          *trends.Tracker
+	blobs           media.BlobStore
+	mediaOrphanTTL  time.Duration
+	schedulerWake   chan struct{}
 }
 
 func main() {
+	// subcommands like `chirpy migrate` run instead of the server
+	if runCommand() {
+		return
+	}
+
 	godotenv.Load(".env")
 
 	jwtSecret := os.Getenv("JWT_SECRET")
@@ -71,15 +158,43 @@ func main() {
 		log.Fatal("POLKA_KEY environment variable is not set")
 	}
 
-	// reads or creates a ne DB ob server start, by checking for JSON-DB
-	db, err := database.NewDB(FILE_DATABASE_PATH)
+	// optional, the admin backup and restore endpoints are only served when set
+	adminKey := os.Getenv("ADMIN_KEY")
+
+	// flag parsing for --debug, to delete database.json programatically,
+	// --db, to choose the storage backend, --cache / --flush-interval,
+	// to keep the JSON-DB in memory and persist it in the background and
+	// --wal / --wal-compact-size, to log mutations instead of rewriting it
+	dbg := flag.Bool("debug", false, "Enable debug mode")
+	backend := flag.String("db", BACKEND_JSON, "Storage backend: json or sqlite")
+	cache := flag.Bool("cache", false, "Keep the JSON database in memory")
+	flushInterval := flag.Duration("flush-interval", 0, "With --cache: batch writes and flush them at this interval, 0 writes through")
+	wal := flag.Bool("wal", false, "Append JSON database mutations to a write-ahead log, implies --cache")
+	walCompactSize := flag.Int64("wal-compact-size", 0, "With --wal: log size in bytes that triggers compaction, 0 uses the default")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Minute, "How often expired refresh tokens, trashed chirps and orphaned media are purged, 0 disables purging")
+	trashRetention := flag.Duration("trash-retention", TRASH_RETENTION, "How long deleted chirps can be restored before they are purged")
+	editWindow := flag.Duration("edit-window", EDIT_WINDOW, "How long after creation chirps can be edited, 0 for no limit")
+	blobStore := flag.String("blob-store", BLOB_STORE_LOCAL, "Where uploaded media is kept: local")
+	mediaDir := flag.String("media-dir", FILE_MEDIA_PATH, "With --blob-store local: directory of uploaded media")
+	mediaOrphanTTL := flag.Duration("media-orphan-ttl", MEDIA_ORPHAN_TTL, "How long uploads can wait to be attached to a chirp before they are purged")
+	flag.Parse()
+
+	// reads or creates a new DB on server start, for the chosen backend
+	opts := encryptionOptions()
+	opts.Cache = *cache
+	opts.FlushInterval = *flushInterval
+	opts.WAL = *wal
+	opts.WALCompactSize = *walCompactSize
+	db, err := openStore(*backend, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blobs, err := openBlobStore(*blobStore, *mediaDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// flag parsing for --debug, to delete database.json programatically
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
 	if dbg != nil && *dbg {
 		err := db.ResetDB()
 		if err != nil {
@@ -88,27 +203,53 @@ func main() {
 	}
 
 	// create apiConfig for serverMetrics and in-memory DB
-	apiCfg := apiConfig{
+	apiCfg := &apiConfig{
 		fileServerHits: 0,
 		DB:             db,
 		jwtSecret:      jwtSecret,
 		polkaKey:       polkaKey,
+		adminKey:       adminKey,
+		trashRetention: *trashRetention,
+		editWindow:     *editWindow,
+		searchIndex:    search.NewIndex(),
+		trends:         trends.NewTracker(),
+		blobs:          blobs,
+		mediaOrphanTTL: *mediaOrphanTTL,
+		schedulerWake:  make(chan struct{}, 1),
 	}
 
 	// create http server multiplexer
 	serveMux := http.NewServeMux()
 
-	// define file server
-	fileServerHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(FILE_ROOT_PATH))))
+	// define file server, on its own directory so database files and backups
+	// in the working directory are never served.
+	// uploaded media is only served by mediaFileHandler, which hides trashed chirps
+	fileServer := middlewareHideDir(http.FileServer(http.Dir(FILE_ROOT_PATH)), FILE_ROOT_PATH, *mediaDir)
+	fileServerHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", fileServer))
 	serveMux.Handle(FILE_SERVER_PATH, fileServerHandler)
+	serveMux.HandleFunc(GET+MEDIA_FILES, apiCfg.mediaFileHandler) // serves uploaded media on GET /media/{key}
 
 	// let multiplexer handle specific endpoints
 	serveMux.HandleFunc(GET+API_HEALTHZ, healthzHandler) // get readiness on GET /api/healthz
 
-	serveMux.HandleFunc(GET+API_CHIRPS, apiCfg.getChirpsHandler)       // gets all chirps in database on GET /api/chirps
-	serveMux.HandleFunc(POST+API_CHIRPS, apiCfg.createChirpHandler)    // posts a new chirp with inbund validation on POST /api/chirps
-	serveMux.HandleFunc(GET+API_CHIRPS_ID, apiCfg.getChirpByIdHandler) // gets a specific chirp in database by id on GET /api/chirps/{chirpID}
-	serveMux.HandleFunc(DELETE+API_CHIRPS_ID, apiCfg.deleteChirpHandler)
+	serveMux.HandleFunc(GET+API_CHIRPS, apiCfg.getChirpsHandler)              // gets all chirps in database on GET /api/chirps
+	serveMux.HandleFunc(POST+API_CHIRPS, apiCfg.createChirpHandler)           // posts a new chirp with inbund validation on POST /api/chirps
+	serveMux.HandleFunc(GET+API_CHIRPS_ID, apiCfg.getChirpByIdHandler)        // gets a specific chirp in database by id on GET /api/chirps/{chirpID}
+	serveMux.HandleFunc(PUT+API_CHIRPS_ID, apiCfg.editChirpHandler)           // edits the body of a chirp of its author
+	serveMux.HandleFunc(DELETE+API_CHIRPS_ID, apiCfg.deleteChirpHandler)      // moves a chirp to the trash of its author
+	serveMux.HandleFunc(GET+API_CHIRPS_SEARCH, apiCfg.searchChirpsHandler)    // full-text search over chirp bodies on GET /api/chirps/search?q=
+	serveMux.HandleFunc(GET+API_CHIRPS_TRASH, apiCfg.getTrashHandler)         // lists the restorable deleted chirps of the user
+	serveMux.HandleFunc(POST+API_CHIRPS_RESTORE, apiCfg.restoreChirpHandler)  // takes a chirp back out of the trash
+	serveMux.HandleFunc(GET+API_CHIRPS_THREAD, apiCfg.getThreadHandler)       // gets the conversation tree a chirp belongs to
+	serveMux.HandleFunc(GET+API_CHIRPS_REVISIONS, apiCfg.getRevisionsHandler) // lists the earlier versions of an edited chirp
+	serveMux.HandleFunc(POST+API_CHIRPS_LIKE, apiCfg.likeChirpHandler)        // likes a chirp as the authenticated user
+	serveMux.HandleFunc(DELETE+API_CHIRPS_LIKE, apiCfg.unlikeChirpHandler)    // takes a like back
+	serveMux.HandleFunc(POST+API_CHIRPS_RECHIRP, apiCfg.rechirpHandler)       // rechirps a chirp as the authenticated user
+	serveMux.HandleFunc(DELETE+API_CHIRPS_RECHIRP, apiCfg.unrechirpHandler)   // takes a rechirp back
+
+	serveMux.HandleFunc(GET+API_SCHEDULED_CHIRPS, apiCfg.getScheduledChirpsHandler)         // lists the chirps the user scheduled for later
+	serveMux.HandleFunc(PUT+API_SCHEDULED_CHIRPS_ID, apiCfg.rescheduleChirpHandler)         // moves a scheduled chirp to a new publish_at
+	serveMux.HandleFunc(DELETE+API_SCHEDULED_CHIRPS_ID, apiCfg.cancelScheduledChirpHandler) // cancels a scheduled chirp before it is published
 
 	serveMux.HandleFunc(GET+API_USERS, apiCfg.getUsersHandler)       // gets all users in database on GET /api/users
 	serveMux.HandleFunc(GET+API_USERS_ID, apiCfg.getUserByIdHandler) // gets a specific user in database by id on GET /api/users/{userID}
@@ -118,16 +259,132 @@ func main() {
 	serveMux.HandleFunc(POST+API_REFRESH, apiCfg.refreshTokenHandler)
 	serveMux.HandleFunc(POST+API_REVOKE, apiCfg.revokeTokenHandler)
 
+	serveMux.HandleFunc(POST+API_USERS_FOLLOW, apiCfg.followUserHandler)     // follows a user as the authenticated user
+	serveMux.HandleFunc(DELETE+API_USERS_FOLLOW, apiCfg.unfollowUserHandler) // stops following a user
+	serveMux.HandleFunc(GET+API_USERS_FOLLOWERS, apiCfg.getFollowersHandler) // lists who follows a user
+	serveMux.HandleFunc(GET+API_USERS_FOLLOWING, apiCfg.getFollowingHandler) // lists whom a user follows
+	serveMux.HandleFunc(GET+API_USERS_MENTIONS, apiCfg.getMentionsHandler)   // lists chirps mentioning a user
+	serveMux.HandleFunc(GET+API_TAGS_CHIRPS, apiCfg.getTagChirpsHandler)     // lists chirps using a hashtag
+	serveMux.HandleFunc(GET+API_TRENDS, apiCfg.getTrendsHandler)             // lists trending hashtags on GET /api/trends?window=hour|day
+	serveMux.HandleFunc(GET+API_TIMELINE, apiCfg.getTimelineHandler)         // chirps of followed users on GET /api/timeline
+
+	serveMux.HandleFunc(POST+API_MEDIA, apiCfg.uploadMediaHandler) // uploads an image to attach to a chirp on POST /api/media
+
 	serveMux.HandleFunc(POST+API_POLKA_WEBHOOKS, apiCfg.webhookhandler)
 
 	serveMux.HandleFunc(GET+ADMIN_METRICS, apiCfg.metricsHandler)            // get visitor count metrics on GET /admin/metrics
 	serveMux.HandleFunc(GET+ADMIN_METRICS_RESET, apiCfg.metricsResetHandler) // resets visitor cound metrics on GET /api/reset
+	if adminKey != "" {
+		serveMux.HandleFunc(GET+ADMIN_BACKUP, apiCfg.backupHandler)    // streams a gzipped database snapshot on GET /admin/backup
+		serveMux.HandleFunc(POST+ADMIN_RESTORE, apiCfg.restoreHandler) // replaces the database with an uploaded snapshot on POST /admin/restore
+	}
 	// serveMux.HandleFunc(POST+API_VALIDATE_CHIRP, validateChirpHandler) // old: validiates a posted chirp on structure and profanity on POST /api/validate_chirp
 
 	// create http.Server object with configured serveMux
 	httpServer := &http.Server{Addr: LOCALHOST + ":" + PORT, Handler: serveMux}
 
+	// shut down gracefully on SIGINT / SIGTERM, so the DB gets flushed and closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// background workers, waited for before the DB is closed
+	workers := &sync.WaitGroup{}
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		err := apiCfg.searchIndex.Sync(ctx, db)
+		if err != nil {
+			log.Printf("search index stopped: %s", err)
+		}
+	}()
+	go func() {
+		defer workers.Done()
+		err := apiCfg.trends.Sync(ctx, db)
+		if err != nil {
+			log.Printf("trends stopped: %s", err)
+		}
+	}()
+	go func() {
+		defer workers.Done()
+		apiCfg.runChirpScheduler(ctx)
+	}()
+	if *sweepInterval > 0 {
+		workers.Add(3)
+		go func() {
+			defer workers.Done()
+			apiCfg.runTokenSweeper(ctx, *sweepInterval)
+		}()
+		go func() {
+			defer workers.Done()
+			apiCfg.runTrashPurger(ctx, *sweepInterval)
+		}()
+		go func() {
+			defer workers.Done()
+			apiCfg.runMediaCollector(ctx, *sweepInterval)
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		err := httpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("could not shut down server: %s", err)
+		}
+	}()
+
 	// log info, start server, inform on fatal or close
 	log.Printf("Serving Yo Mama from %s on port: %s\n", FILE_ROOT_PATH, PORT)
-	log.Fatal(httpServer.ListenAndServe())
+	err = httpServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	stop()
+	workers.Wait()
+	err = db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
+
+// opens the database.Store for the given backend name
+func openStore(backend string, opts database.Options) (database.Store, error) {
+	switch backend {
+	case BACKEND_JSON:
+		return database.NewDBWithOptions(FILE_DATABASE_PATH, opts)
+	case BACKEND_SQLITE:
+		if opts.EncryptionKey != "" {
+			return nil, errors.New("DB_ENCRYPTION_KEY is only supported by the json backend")
+		}
+		return database.NewSQLiteDBWithOptions(FILE_SQLITE_PATH, opts)
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", backend)
+	}
+}
+
+// opens the media.BlobStore for the given store name
+func openBlobStore(store, dir string) (media.BlobStore, error) {
+	switch store {
+	case BLOB_STORE_LOCAL:
+		return media.NewLocalStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", store)
+	}
+}
+
+// reads the optional encryption keys for the JSON-DB from the environment.
+// DB_ENCRYPTION_KEY is the current key, DB_ENCRYPTION_KEY_PREVIOUS a comma
+// separated list of keys still accepted for reading while rotating
+func encryptionOptions() database.Options {
+	opts := database.Options{
+		EncryptionKey: os.Getenv("DB_ENCRYPTION_KEY"),
+	}
+	previous := os.Getenv("DB_ENCRYPTION_KEY_PREVIOUS")
+	if previous != "" {
+		opts.PreviousEncryptionKeys = strings.Split(previous, ",")
+	}
+	return opts
 }
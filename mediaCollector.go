@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+)
+
+// Collects orphaned uploads every interval until ctx is done:
+// uploads never attached to a chirp within apiConfig.mediaOrphanTTL,
+// and blobs without an upload recorded for them, left behind by purged
+// chirps, failed uploads or a restore. The number of removed blobs is
+// added to apiConfig.collectedMedia and shown on the metrics page
+func (a *apiConfig) runMediaCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.collectMedia(time.Now().Add(-a.mediaOrphanTTL))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Blobs younger than before are left alone, they may belong
+// to an upload that is recorded right now
+func (a *apiConfig) collectMedia(before time.Time) {
+	orphans, err := a.DB.PurgeOrphanedMedia(before)
+	if err != nil {
+		log.Printf("could not purge orphaned media: %s", err)
+		return
+	}
+	for _, orphan := range orphans {
+		a.deleteBlob(orphan.Key)
+	}
+	a.collectedMedia.Add(int64(len(orphans)))
+
+	blobs, err := a.blobs.List()
+	if err != nil {
+		log.Printf("could not list blobs: %s", err)
+		return
+	}
+	for _, blob := range blobs {
+		if !blob.ModTime.Before(before) {
+			continue
+		}
+		_, err := a.DB.GetMediaByKey(blob.Key)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, database.ErrNotExist) {
+			log.Printf("could not look up blob %s: %s", blob.Key, err)
+			continue
+		}
+		a.deleteBlob(blob.Key)
+		a.collectedMedia.Add(1)
+	}
+}
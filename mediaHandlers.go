@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/media"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// largest accepted upload in bytes, and most uploads one chirp can carry
+const (
+	MEDIA_MAX_SIZE      int64 = 5 << 20
+	MEDIA_MAX_PER_CHIRP int   = 4
+)
+
+// URL is where the file is served, see mediaFileHandler
+type Media struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func mediaFromDB(dbMedia database.Media) Media {
+	return Media{
+		ID:          dbMedia.ID,
+		URL:         strings.Replace(MEDIA_FILES, "{key}", dbMedia.Key, 1),
+		ContentType: dbMedia.ContentType,
+		Size:        dbMedia.Size,
+		CreatedAt:   dbMedia.CreatedAt,
+	}
+}
+
+// handler to be used with serveMux.HandleFunc()
+// this handler stores an image from the multipart form field "file".
+// The type is sniffed from the bytes and metadata is stripped before
+// anything is stored, see media.Sanitize. The returned ID can be attached
+// to a chirp via media_ids, uploads that never are get collected
+func (a *apiConfig) uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	// room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, MEDIA_MAX_SIZE+1<<20)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			utils.RespondWithError(w, http.StatusRequestEntityTooLarge, "file is too large")
+			return
+		}
+		utils.RespondWithError(w, http.StatusBadRequest, "could not find file in multipart form")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, MEDIA_MAX_SIZE+1))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "could not read file")
+		return
+	}
+	if int64(len(data)) > MEDIA_MAX_SIZE {
+		utils.RespondWithError(w, http.StatusRequestEntityTooLarge, "file is too large")
+		return
+	}
+
+	contentType, data, err := media.Sanitize(data)
+	if err != nil {
+		if errors.Is(err, media.ErrUnsupportedType) {
+			utils.RespondWithError(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key, err := media.NewKey(contentType)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not generate media key")
+		return
+	}
+
+	// bytes first, so a recorded upload always has them.
+	// If recording fails the blob is an orphan for the collector
+	err = a.blobs.Put(key, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("could not store blob %s: %s", key, err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not store file")
+		return
+	}
+
+	dbMedia, err := a.DB.CreateMedia(userID, key, contentType, int64(len(data)))
+	if err != nil {
+		a.deleteBlob(key)
+		if errors.Is(err, database.ErrNotExist) {
+			utils.RespondWithError(w, http.StatusNotFound, "could not find user")
+			return
+		}
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not record upload")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusCreated, mediaFromDB(dbMedia))
+}
+
+// handler to be used with serveMux.HandleFunc()
+// this handler serves the file of an upload, next to the /app/ file server.
+// Files of chirps in the trash are hidden with them
+func (a *apiConfig) mediaFileHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "key"
+	dbMedia, err := a.DB.GetMediaByKey(r.PathValue(matchingPattern))
+	if err != nil {
+		if errors.Is(err, database.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "could not look up media", http.StatusInternalServerError)
+		return
+	}
+
+	if dbMedia.ChirpID != 0 {
+		dbChirp, err := a.DB.GetChirpByID(dbMedia.ChirpID)
+		if err != nil || dbChirp.IsDeleted() {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	blob, err := a.blobs.Open(dbMedia.Key)
+	if err != nil {
+		if errors.Is(err, media.ErrBlobNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "could not open media", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// keys are never reused, so the bytes under one never change
+	w.Header().Set("Content-Type", dbMedia.ContentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, dbMedia.Key, blob.ModTime(), blob)
+}
+
+// removes a blob, logging instead of failing, the collector retries
+func (a *apiConfig) deleteBlob(key string) {
+	err := a.blobs.Delete(key)
+	if err != nil {
+		log.Printf("could not delete blob %s: %s", key, err)
+	}
+}
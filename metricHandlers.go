@@ -10,7 +10,7 @@ import (
 func (a *apiConfig) metricsHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Add("content-Type", "text/html; charset=utf-8")
 	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", a.fileServerHits)))
+	writer.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p><p>Expired refresh tokens reaped: %d</p><p>Deleted chirps purged: %d</p><p>Orphaned media collected: %d</p><p>Scheduled chirps published: %d</p></body></html>", a.fileServerHits, a.reapedTokens.Load(), a.purgedChirps.Load(), a.collectedMedia.Load(), a.publishedChirps.Load())))
 }
 
 // handler to be used with serveMux.HandleFunc()
@@ -1,6 +1,11 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
 
 /*
 returns a http.Handler by use of http.HandlerFunc().
@@ -14,3 +19,39 @@ func (a *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(writer, request)
 	})
 }
+
+/*
+returns a http.Handler that answers 404 for everything below dir
+and passes all other requests on to next.
+
+next serves the files below root, like http.FileServer() does.
+dir is skipped when it lies outside of root. This keeps the file server
+from handing out files that have their own handler, like uploaded media.
+Matching ignores case, for case-insensitive file systems.
+*/
+func middlewareHideDir(next http.Handler, root, dir string) http.Handler {
+	absRoot, rootErr := filepath.Abs(root)
+	absDir, dirErr := filepath.Abs(dir)
+	// without absolute paths there is no telling what to hide
+	if rootErr != nil || dirErr != nil {
+		return http.NotFoundHandler()
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return next
+	}
+	// the served root itself holds the media
+	if rel == "." {
+		return http.NotFoundHandler()
+	}
+	hidden := strings.ToLower("/" + filepath.ToSlash(rel))
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requested := strings.ToLower(path.Clean("/" + request.URL.Path))
+		if requested == hidden || strings.HasPrefix(requested, hidden+"/") {
+			http.NotFound(writer, request)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
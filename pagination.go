@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// upper bound for the limit query parameter
+const MAX_PAGE_LIMIT int = 1000
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+/*
+	CURSOR PAGINATION:
+	list endpoints take an optional limit and the opaque cursor of the
+	previous page. A cursor holds the sort key of the last item handed out,
+	so the next page starts right after it no matter how many items were
+	created or deleted in between. The body stays a plain JSON array,
+	the next page is announced in headers:
+
+	X-Next-Cursor: eyJpZCI6M30
+	Link: </api/chirps?cursor=eyJpZCI6M30&limit=3>; rel="next"
+*/
+
+// the sort key of the last item of a page
+type pageCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int       `json:"id"`
+	Desc      bool      `json:"desc,omitempty"`
+}
+
+// the limit and cursor query parameters of a list request.
+// A limit of 0 returns everything after the cursor
+type pageParams struct {
+	limit  int
+	cursor *pageCursor
+}
+
+func parsePageParams(r *http.Request) (pageParams, error) {
+	params := pageParams{}
+
+	limitString := r.URL.Query().Get("limit")
+	if limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > MAX_PAGE_LIMIT {
+			return pageParams{}, fmt.Errorf("limit must be between 1 and %d", MAX_PAGE_LIMIT)
+		}
+		params.limit = limit
+	}
+
+	cursorString := r.URL.Query().Get("cursor")
+	if cursorString != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursorString)
+		if err != nil {
+			return pageParams{}, errInvalidCursor
+		}
+		cursor := pageCursor{}
+		err = json.Unmarshal(data, &cursor)
+		if err != nil {
+			return pageParams{}, errInvalidCursor
+		}
+		params.cursor = &cursor
+	}
+	return params, nil
+}
+
+func (cursor pageCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Cuts one page out of items, which must be sorted by their cursor.
+// isAfter reports whether an item comes after the cursor of the
+// previous page; more whether items are left after the page
+func paginate[T any](items []T, params pageParams, isAfter func(T) bool) (page []T, more bool) {
+	start := 0
+	if params.cursor != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return isAfter(items[i])
+		})
+	}
+	items = items[start:]
+
+	if params.limit == 0 || len(items) <= params.limit {
+		return items, false
+	}
+	return items[:params.limit], true
+}
+
+// announces the next page via X-Next-Cursor and a Link header
+// repeating the request with cursor replaced
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor pageCursor) {
+	encoded := cursor.encode()
+
+	query := r.URL.Query()
+	query.Set("cursor", encoded)
+	next := r.URL.Path + "?" + query.Encode()
+
+	w.Header().Set("X-Next-Cursor", encoded)
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// likes the chirp in the path as the authenticated user
+func (a *apiConfig) likeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	a.reactToChirp(w, r, database.ReactionLike, true)
+}
+
+// takes back the like of the authenticated user
+func (a *apiConfig) unlikeChirpHandler(w http.ResponseWriter, r *http.Request) {
+	a.reactToChirp(w, r, database.ReactionLike, false)
+}
+
+// rechirps the chirp in the path as the authenticated user
+func (a *apiConfig) rechirpHandler(w http.ResponseWriter, r *http.Request) {
+	a.reactToChirp(w, r, database.ReactionRechirp, true)
+}
+
+// takes back the rechirp of the authenticated user
+func (a *apiConfig) unrechirpHandler(w http.ResponseWriter, r *http.Request) {
+	a.reactToChirp(w, r, database.ReactionRechirp, false)
+}
+
+// adds or removes the reaction of kind of the authenticated user
+// to the chirp in the path and responds with the updated chirp.
+// Both are idempotent, a user counts at most once per chirp and kind
+func (a *apiConfig) reactToChirp(w http.ResponseWriter, r *http.Request, kind database.ReactionKind, add bool) {
+	const matchingPattern string = "chirpID"
+	chirpIDString := r.PathValue(matchingPattern)
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid chirp id")
+		return
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	if add {
+		err = a.DB.React(kind, chirpID, userID)
+	} else {
+		err = a.DB.Unreact(kind, chirpID, userID)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrNotExist) {
+			utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+			return
+		}
+		if errors.Is(err, database.ErrChirpDeleted) {
+			utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+			return
+		}
+
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not update "+string(kind))
+		return
+	}
+
+	dbChirp, err := a.DB.GetChirpByID(chirpID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+		return
+	}
+	// trashed since the reaction was recorded
+	if dbChirp.IsDeleted() {
+		utils.RespondWithError(w, http.StatusGone, "chirp was deleted")
+		return
+	}
+
+	chirps := []Chirp{chirpFromDB(dbChirp)}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, chirps[0])
+}
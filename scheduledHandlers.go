@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// a chirp waiting to be published, Error is set
+// when publishing failed until it is rescheduled
+type ScheduledChirp struct {
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	InReplyTo int       `json:"in_reply_to,omitempty"`
+	MediaIDs  []int     `json:"media_ids"`
+	PublishAt time.Time `json:"publish_at"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func scheduledChirpFromDB(dbScheduled database.ScheduledChirp) ScheduledChirp {
+	if dbScheduled.MediaIDs == nil {
+		dbScheduled.MediaIDs = []int{}
+	}
+	return ScheduledChirp{
+		ID:        dbScheduled.ID,
+		AuthorID:  dbScheduled.AuthorID,
+		Body:      dbScheduled.Body,
+		InReplyTo: dbScheduled.InReplyTo,
+		MediaIDs:  dbScheduled.MediaIDs,
+		PublishAt: dbScheduled.PublishAt,
+		Error:     dbScheduled.Error,
+		CreatedAt: dbScheduled.CreatedAt,
+		UpdatedAt: dbScheduled.UpdatedAt,
+	}
+}
+
+// lists the scheduled chirps of the user, the next one to be published first
+func (a *apiConfig) getScheduledChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	dbScheduled, err := a.DB.GetScheduledChirps(userID)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve scheduled chirps")
+		return
+	}
+
+	scheduled := make([]ScheduledChirp, len(dbScheduled))
+	for i, s := range dbScheduled {
+		scheduled[i] = scheduledChirpFromDB(s)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, scheduled)
+}
+
+// moves a scheduled chirp of the user to a new publish_at,
+// which also retries one that failed to publish
+func (a *apiConfig) rescheduleChirpHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PublishAt time.Time `json:"publish_at"`
+	}
+
+	scheduledID, ok := a.authorizeScheduledChirp(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not decode parameters")
+		return
+	}
+
+	if !params.PublishAt.After(time.Now()) {
+		utils.RespondWithError(w, http.StatusBadRequest, "publish_at must be in the future")
+		return
+	}
+
+	scheduled, err := a.DB.RescheduleChirp(scheduledID, params.PublishAt)
+	if errors.Is(err, database.ErrNotExist) {
+		// published or cancelled concurrently
+		utils.RespondWithError(w, http.StatusNotFound, "could not find scheduled chirp")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not reschedule chirp")
+		return
+	}
+
+	a.wakeScheduler()
+	utils.RespondWithJSON(w, http.StatusOK, scheduledChirpFromDB(scheduled))
+}
+
+// cancels a scheduled chirp of the user, its media can be attached elsewhere again
+func (a *apiConfig) cancelScheduledChirpHandler(w http.ResponseWriter, r *http.Request) {
+	scheduledID, ok := a.authorizeScheduledChirp(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.DB.CancelScheduledChirp(scheduledID)
+	if errors.Is(err, database.ErrNotExist) {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find scheduled chirp")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not cancel scheduled chirp")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reads the scheduled chirp ID from the path and checks that it exists
+// and belongs to the authenticated user, responding with an error otherwise
+func (a *apiConfig) authorizeScheduledChirp(w http.ResponseWriter, r *http.Request) (int, bool) {
+	const matchingPattern string = "scheduledID"
+	scheduledID, err := strconv.Atoi(r.PathValue(matchingPattern))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid scheduled chirp id")
+		return 0, false
+	}
+
+	userID, ok := a.authenticateUser(w, r)
+	if !ok {
+		return 0, false
+	}
+
+	scheduled, err := a.DB.GetScheduledChirpByID(scheduledID)
+	if errors.Is(err, database.ErrNotExist) {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find scheduled chirp")
+		return 0, false
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve scheduled chirp")
+		return 0, false
+	}
+
+	if scheduled.AuthorID != userID {
+		utils.RespondWithError(w, http.StatusForbidden, "you cannot change this scheduled chirp")
+		return 0, false
+	}
+	return scheduledID, true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Katalcha/go-chirpy/internal/search"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// number of search results returned without, and at most with, a limit
+const (
+	SEARCH_DEFAULT_LIMIT int = 20
+	SEARCH_MAX_LIMIT     int = 100
+)
+
+// handler to be used with serveMux.HandleFunc()
+// this handler searches chirp bodies, see search.ParseQuery for the syntax
+func (a *apiConfig) searchChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	type result struct {
+		Chirp
+		Score float64 `json:"score"`
+	}
+
+	query, err := search.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	authorID := 0
+	authorIDString := r.URL.Query().Get("author_id")
+	if authorIDString != "" {
+		authorID, err = strconv.Atoi(authorIDString)
+		if err != nil || authorID < 1 {
+			utils.RespondWithError(w, http.StatusBadRequest, "invalid author id")
+			return
+		}
+	}
+
+	limit := SEARCH_DEFAULT_LIMIT
+	limitString := r.URL.Query().Get("limit")
+	if limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > SEARCH_MAX_LIMIT {
+			utils.RespondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	matches := a.searchIndex.Search(query, authorID, limit)
+	chirps := make([]Chirp, len(matches))
+	for i, match := range matches {
+		chirps[i] = chirpFromDB(match.Chirp)
+	}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	results := []result{}
+	for i, match := range matches {
+		results = append(results, result{
+			Chirp: chirps[i],
+			Score: match.Score,
+		})
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Katalcha/go-chirpy/internal/database"
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// one chirp of a conversation tree with its replies, oldest first.
+// Deleted chirps that still have replies stay in the tree as a
+// placeholder without Chirp, so their replies keep their place.
+// ID shadows Chirp.ID, it is set for placeholders too
+type threadNode struct {
+	ID int `json:"id"`
+	*Chirp
+	Deleted bool          `json:"deleted,omitempty"`
+	Replies []*threadNode `json:"replies"`
+
+	// whether the chirp is still stored, deleted or not
+	stored bool
+}
+
+// handler to be used with serveMux.HandleFunc()
+// returns the whole conversation the chirp in the path belongs to,
+// starting at the chirp that started it
+func (a *apiConfig) getThreadHandler(w http.ResponseWriter, r *http.Request) {
+	const matchingPattern string = "chirpID"
+	chirpIDString := r.PathValue(matchingPattern)
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid chirp id")
+		return
+	}
+
+	dbChirps, err := a.DB.GetThread(chirpID)
+	if errors.Is(err, database.ErrNotExist) {
+		utils.RespondWithError(w, http.StatusNotFound, "could not find chirp")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not retrieve thread")
+		return
+	}
+
+	chirps := make([]Chirp, len(dbChirps))
+	for i, dbChirp := range dbChirps {
+		chirps[i] = chirpFromDB(dbChirp)
+	}
+	err = a.setCounts(r, chirps)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "could not count replies and reactions")
+		return
+	}
+
+	root := buildThread(chirps)
+	if root == nil {
+		utils.RespondWithError(w, http.StatusGone, "thread was deleted")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, root)
+}
+
+// arranges the chirps of one thread into a tree, nil if nothing of it
+// is left to show. Parents purged from the trash become placeholders
+// just like deleted ones; as nothing tells where they were in the tree,
+// they hang off the root
+func buildThread(chirps []Chirp) *threadNode {
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirpKeyBefore(chirps[i].CreatedAt, chirps[i].ID, chirps[j].CreatedAt, chirps[j].ID)
+	})
+
+	nodes := map[int]*threadNode{}
+	node := func(id int) *threadNode {
+		n, ok := nodes[id]
+		if !ok {
+			n = &threadNode{ID: id, Deleted: true, Replies: []*threadNode{}}
+			nodes[id] = n
+		}
+		return n
+	}
+
+	rootID := 0
+	for i := range chirps {
+		chirp := &chirps[i]
+		n := node(chirp.ID)
+		n.stored = true
+		if chirp.DeletedAt == nil {
+			n.Chirp = chirp
+			n.Deleted = false
+		}
+
+		if chirp.InReplyTo == 0 {
+			rootID = chirp.ID
+			continue
+		}
+		rootID = chirp.RootID
+		parent := node(chirp.InReplyTo)
+		parent.Replies = append(parent.Replies, n)
+	}
+
+	root := node(rootID)
+	purged := []*threadNode{}
+	for _, n := range nodes {
+		if !n.stored && n != root {
+			purged = append(purged, n)
+		}
+	}
+	sort.Slice(purged, func(i, j int) bool {
+		return purged[i].ID < purged[j].ID
+	})
+	root.Replies = append(root.Replies, purged...)
+
+	return pruneThread(root)
+}
+
+// drops placeholders without replies left to show
+func pruneThread(n *threadNode) *threadNode {
+	replies := []*threadNode{}
+	for _, reply := range n.Replies {
+		reply = pruneThread(reply)
+		if reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	n.Replies = replies
+
+	if n.Deleted && len(replies) == 0 {
+		return nil
+	}
+	return n
+}
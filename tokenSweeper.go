@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Purges expired refresh tokens every interval until ctx is done.
+// The number of reaped tokens is added to apiConfig.reapedTokens
+// and shown on the metrics page
+func (a *apiConfig) runTokenSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			purged, err := a.DB.PurgeExpiredRefreshTokens(time.Now())
+			if err != nil {
+				log.Printf("could not purge expired refresh tokens: %s", err)
+				continue
+			}
+			a.reapedTokens.Add(int64(purged))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Hard-deletes chirps that sat in the trash longer than
+// apiConfig.trashRetention, every interval until ctx is done.
+// The number of purged chirps is added to apiConfig.purgedChirps
+// and shown on the metrics page
+func (a *apiConfig) runTrashPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			purged, err := a.DB.PurgeDeletedChirps(time.Now().Add(-a.trashRetention))
+			if err != nil {
+				log.Printf("could not purge deleted chirps: %s", err)
+				continue
+			}
+			a.purgedChirps.Add(int64(purged))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
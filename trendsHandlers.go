@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Katalcha/go-chirpy/internal/utils"
+)
+
+// number of trends returned without, and at most with, a limit
+const (
+	TRENDS_DEFAULT_LIMIT int = 10
+	TRENDS_MAX_LIMIT     int = 100
+)
+
+// the sliding windows trends can be asked for
+var trendWindows = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// handler to be used with serveMux.HandleFunc()
+// lists the trending hashtags of the last hour, or day with ?window=day
+func (a *apiConfig) getTrendsHandler(w http.ResponseWriter, r *http.Request) {
+	windowName := r.URL.Query().Get("window")
+	if windowName == "" {
+		windowName = "hour"
+	}
+	window, ok := trendWindows[windowName]
+	if !ok {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid window, expected hour or day")
+		return
+	}
+
+	limit := TRENDS_DEFAULT_LIMIT
+	limitString := r.URL.Query().Get("limit")
+	if limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > TRENDS_MAX_LIMIT {
+			utils.RespondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, a.trends.Top(window, limit))
+}
@@ -14,10 +14,23 @@ import (
 )
 
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"-"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"-"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// maps a database.User to its JSON response, without the password hash
+func userFromDB(dbUser database.User) User {
+	return User{
+		ID:          dbUser.ID,
+		Email:       dbUser.Email,
+		IsChirpyRed: dbUser.IsChirpyRed,
+		CreatedAt:   dbUser.CreatedAt,
+		UpdatedAt:   dbUser.UpdatedAt,
+	}
 }
 
 func (a *apiConfig) createUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -56,34 +69,39 @@ func (a *apiConfig) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.RespondWithJSON(w, http.StatusCreated, response{
-		User: User{
-			ID:          user.ID,
-			Email:       user.Email,
-			IsChirpyRed: user.IsChirpyRed,
-		},
+		User: userFromDB(user),
 	})
 }
 
 func (a *apiConfig) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageParams(r)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	dbUsers, err := a.DB.GetUsers()
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "Could not get users from database")
 		return
 	}
 
-	users := []database.User{}
+	users := []User{}
 	for _, dbUser := range dbUsers {
-		users = append(users, database.User{
-			ID:             dbUser.ID,
-			Email:          dbUser.Email,
-			HashedPassword: dbUser.HashedPassword,
-		})
+		users = append(users, userFromDB(dbUser))
 	}
 
 	sort.Slice(users, func(i, j int) bool {
 		return users[i].ID < users[j].ID
 	})
 
+	users, more := paginate(users, page, func(user User) bool {
+		return user.ID > page.cursor.ID
+	})
+	if more {
+		setNextPage(w, r, pageCursor{ID: users[len(users)-1].ID})
+	}
+
 	utils.RespondWithJSON(w, http.StatusOK, users)
 }
 
@@ -107,10 +125,7 @@ func (a *apiConfig) getUserByIdHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.RespondWithJSON(w, http.StatusOK, response{
-		User: User{
-			ID:    dbUser.ID,
-			Email: dbUser.Email,
-		},
+		User: userFromDB(dbUser),
 	})
 }
 
@@ -158,16 +173,17 @@ func (a *apiConfig) updateUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	user, err := a.DB.UpdateUser(userIDInt, params.Email, hashedPassword)
 	if err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			utils.RespondWithError(w, http.StatusConflict, "email already in use")
+			return
+		}
+
 		utils.RespondWithError(w, http.StatusInternalServerError, "could not update user")
 		return
 	}
 
 	utils.RespondWithJSON(w, http.StatusOK, response{
-		User: User{
-			ID:          user.ID,
-			Email:       user.Email,
-			IsChirpyRed: user.IsChirpyRed,
-		},
+		User: userFromDB(user),
 	})
 }
 
@@ -226,11 +242,7 @@ func (a *apiConfig) loginUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.RespondWithJSON(w, http.StatusOK, response{
-		User: User{
-			ID:          user.ID,
-			Email:       user.Email,
-			IsChirpyRed: user.IsChirpyRed,
-		},
+		User:         userFromDB(user),
 		Token:        accessToken,
 		RefreshToken: refreshToken,
 	})
@@ -283,3 +295,46 @@ func (a *apiConfig) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// reads the user ID from the JWT in the Authorization header,
+// responding with an error if it is missing or invalid
+func (a *apiConfig) authenticateUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "could not find jwt")
+		return 0, false
+	}
+
+	subject, err := auth.ValidateJWT(token, a.jwtSecret)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "could not validate jwt")
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(subject)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "could not parse user id")
+		return 0, false
+	}
+	return userID, true
+}
+
+// the user ID of the JWT in the Authorization header of a request
+// that works without one, 0 if there is no valid jwt
+func (a *apiConfig) requestUser(r *http.Request) int {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return 0
+	}
+
+	subject, err := auth.ValidateJWT(token, a.jwtSecret)
+	if err != nil {
+		return 0
+	}
+
+	userID, err := strconv.Atoi(subject)
+	if err != nil {
+		return 0
+	}
+	return userID
+}